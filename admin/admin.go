@@ -0,0 +1,614 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package admin implements JSON HTTP API for gateway operators.
+// It does not authenticate requests itself; it should listen on loopback address or be wrapped by auth.RequireToken.
+//
+// Endpoints:
+//
+//	GET    /v1/agents               - list connected agents
+//	GET    /v1/agents/{uuid}        - get agent
+//	DELETE /v1/agents/{uuid}        - kick agent session
+//	POST   /v1/agents/{uuid}/ping   - ping agent, response is PingResponse
+//	POST   /v1/agents/{uuid}/revoke - revoke agent's certificates issued by built-in CA and kick its session,
+//	                                  response is RevokeResponse
+//	GET    /v1/tunnels              - list tunnels
+//	POST   /v1/tunnels              - create tunnel, body is CreateTunnelRequest
+//	GET    /v1/tunnels/{id}         - get tunnel
+//	DELETE /v1/tunnels/{id}         - close tunnel and all its connections, even if agent is disconnected
+//	POST   /v1/enrollment-tokens    - create registration token for built-in CA, body is CreateTokenRequest
+//	GET    /v1/ports                - list stable tunnel port allocations
+//	DELETE /v1/ports/{port}         - release port allocation
+//	GET    /v1/declarations/drift   - list differences between declared and actual tunnels, see Drift
+//	GET    /v1/known-agents         - list agents known to state store, see KnownAgent
+//	DELETE /v1/known-agents/{uuid}  - forget agent, its persistent tunnels and port allocations
+//
+// Prometheus endpoints are served by PrometheusServer on a separate listener, so Prometheus does not get
+// access to admin API:
+//
+//	GET    /v1/targets              - list tunnels as Prometheus HTTP service discovery targets, see TargetGroup
+//	GET    /agents/{uuid}/scrape?target=127.0.0.1:9100&path=/metrics - proxy request (not JSON) to target via agent;
+//	                                  target should be loopback or tunnel dial address for that agent
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-gateway/ca"
+	"github.com/Percona-Lab/pmm-gateway/ports"
+	"github.com/Percona-Lab/pmm-gateway/static"
+	"github.com/Percona-Lab/pmm-gateway/store"
+	"github.com/Percona-Lab/pmm-gateway/tunnel"
+)
+
+const (
+	maxRequestSize = 64 * 1024
+	pingTimeout    = 10 * time.Second
+	maxWeight      = 100
+)
+
+// Agent represents connected agent.
+type Agent struct {
+	UUID        string            `json:"uuid"`
+	Hostname    string            `json:"hostname,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	AuthMethod  string            `json:"auth_method"`
+	RemoteAddr  string            `json:"remote_addr"`
+	ConnectedAt time.Time         `json:"connected_at"`
+	SessionID   string            `json:"session_id,omitempty"`   // for resumable session
+	Suspended   bool              `json:"suspended,omitempty"`    // connection broke, session is waiting for resume
+	Liveness    string            `json:"liveness"`               // see tunnel.Liveness* constants
+	LastPongAt  *time.Time        `json:"last_pong_at,omitempty"` // nil if there was no pong yet
+	MissedPongs int               `json:"missed_pongs"`
+	LatencyMs   float64           `json:"latency_ms"`
+	Tunnels     int               `json:"tunnels"`
+}
+
+// Conn represents tunnel's live connection.
+type Conn struct {
+	AgentTunnelID string `json:"agent_tunnel_id"`
+	RemoteAddr    string `json:"remote_addr"`
+}
+
+// Tunnel represents tunnel.
+type Tunnel struct {
+	ID             string     `json:"id"`
+	AgentUUID      string     `json:"agent_uuid"`
+	Listen         string     `json:"listen"`
+	Dial           string     `json:"dial"`
+	Weight         int        `json:"weight"`
+	ServiceType    string     `json:"service_type,omitempty"`
+	Persistent     bool       `json:"persistent"`      // restored when agent reconnects
+	AgentConnected bool       `json:"agent_connected"` // false during grace period after agent disconnected
+	CreatedAt      time.Time  `json:"created_at"`
+	ExpiresAt      *time.Time `json:"expires_at,omitempty"`
+	Conns          []Conn     `json:"conns"`
+
+	LastError     string         `json:"last_error,omitempty"`
+	LastErrorCode string         `json:"last_error_code,omitempty"` // like "DIAL_REFUSED", see agent.ErrorCode
+	LastErrorAt   *time.Time     `json:"last_error_at,omitempty"`
+	Errors        map[string]int `json:"errors,omitempty"` // error code -> number of errors
+}
+
+// CreateTunnelRequest is a body of tunnel creation request.
+type CreateTunnelRequest struct {
+	AgentUUID   string `json:"agent_uuid"`
+	Dial        string `json:"dial"`
+	TTL         string `json:"ttl,omitempty"`          // Go duration, like "1h"; empty for no TTL
+	Weight      int    `json:"weight,omitempty"`       // share of agent's connection relative to other tunnels, 1 by default
+	ServiceType string `json:"service_type,omitempty"` // like "node_exporter", used for service discovery
+}
+
+// PingResponse is a body of agent ping response.
+type PingResponse struct {
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// RevokeResponse is a body of agent revocation response.
+type RevokeResponse struct {
+	Revoked int  `json:"revoked"` // number of revoked certificates
+	Kicked  bool `json:"kicked"`  // true if agent was connected
+}
+
+// PortAllocation represents stable tunnel port allocation.
+type PortAllocation struct {
+	Port      int    `json:"port"`
+	AgentUUID string `json:"agent_uuid"`
+	Dial      string `json:"dial"`
+}
+
+// KnownAgent represents agent that was connected at least once.
+type KnownAgent struct {
+	UUID        string            `json:"uuid"`
+	Hostname    string            `json:"hostname,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	RemoteAddr  string            `json:"remote_addr"`
+	FirstSeenAt time.Time         `json:"first_seen_at"`
+	LastSeenAt  time.Time         `json:"last_seen_at"`
+	Connected   bool              `json:"connected"`
+	Liveness    string            `json:"liveness,omitempty"` // for connected agent, or "dead" if the last session was evicted
+}
+
+// Drift represents difference between declared and actual tunnels.
+type Drift struct {
+	AgentUUID string `json:"agent_uuid"`
+	Dial      string `json:"dial"`
+	State     string `json:"state"` // "missing", "undeclared", or "agent_disconnected"
+	TunnelID  string `json:"tunnel_id,omitempty"`
+	Error     string `json:"error,omitempty"` // the last error of declared tunnel creation
+}
+
+// CreateTokenRequest is a body of registration token creation request.
+type CreateTokenRequest struct {
+	TTL string `json:"ttl"` // Go duration, like "1h"
+}
+
+// CreateTokenResponse is a body of registration token creation response.
+type CreateTokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Error is a body of error response.
+type Error struct {
+	Error string `json:"error"`
+}
+
+// Server serves admin API.
+type Server struct {
+	registry  *tunnel.Registry
+	authority *ca.CA
+	allocator *ports.Allocator
+	decls     *static.Manager
+	store     *store.Store
+	mux       *http.ServeMux
+}
+
+// NewServer creates a new admin API server for given registry, built-in CA, port allocator,
+// static tunnel declarations, and state store (last four may be nil).
+func NewServer(registry *tunnel.Registry, authority *ca.CA, allocator *ports.Allocator, decls *static.Manager, st *store.Store) *Server {
+	s := &Server{
+		registry:  registry,
+		authority: authority,
+		allocator: allocator,
+		decls:     decls,
+		store:     st,
+		mux:       http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/v1/agents", s.handleAgents)
+	s.mux.HandleFunc("/v1/agents/", s.handleAgent)
+	s.mux.HandleFunc("/v1/tunnels", s.handleTunnels)
+	s.mux.HandleFunc("/v1/tunnels/", s.handleTunnel)
+	s.mux.HandleFunc("/v1/enrollment-tokens", s.handleTokens)
+	s.mux.HandleFunc("/v1/ports", s.handlePorts)
+	s.mux.HandleFunc("/v1/ports/", s.handlePort)
+	s.mux.HandleFunc("/v1/declarations/drift", s.handleDrift)
+	s.mux.HandleFunc("/v1/known-agents", s.handleKnownAgents)
+	s.mux.HandleFunc("/v1/known-agents/", s.handleKnownAgent)
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.mux.ServeHTTP(rw, req)
+}
+
+func (s *Server) handleAgents(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(rw, http.StatusMethodNotAllowed, "method %s is not allowed", req.Method)
+		return
+	}
+
+	res := []Agent{}
+	for _, svc := range s.registry.Services() {
+		res = append(res, convertAgent(svc))
+	}
+	writeJSON(rw, http.StatusOK, res)
+}
+
+func (s *Server) handleAgent(rw http.ResponseWriter, req *http.Request) {
+	uuid := strings.TrimPrefix(req.URL.Path, "/v1/agents/")
+	var ping bool
+	if strings.HasSuffix(uuid, "/ping") {
+		uuid = strings.TrimSuffix(uuid, "/ping")
+		ping = true
+	}
+	if strings.HasSuffix(uuid, "/revoke") {
+		// agent may be disconnected
+		s.handleRevoke(rw, req, strings.TrimSuffix(uuid, "/revoke"))
+		return
+	}
+	svc := s.registry.Get(uuid)
+	if svc == nil {
+		writeError(rw, http.StatusNotFound, "agent %q is not connected", uuid)
+		return
+	}
+
+	if ping {
+		if req.Method != "POST" {
+			writeError(rw, http.StatusMethodNotAllowed, "method %s is not allowed", req.Method)
+			return
+		}
+		latency, err := svc.Ping(pingTimeout)
+		if err != nil {
+			writeError(rw, http.StatusGatewayTimeout, "%s", err)
+			return
+		}
+		writeJSON(rw, http.StatusOK, &PingResponse{LatencyMs: latency.Seconds() * 1000})
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		writeJSON(rw, http.StatusOK, convertAgent(svc))
+	case "DELETE":
+		logrus.Infof("Admin API: kicking agent %q.", uuid)
+		svc.Kick()
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(rw, http.StatusMethodNotAllowed, "method %s is not allowed", req.Method)
+	}
+}
+
+// handleRevoke revokes agent's certificates and kicks its session, so it can't reconnect with them.
+func (s *Server) handleRevoke(rw http.ResponseWriter, req *http.Request, uuid string) {
+	if req.Method != "POST" {
+		writeError(rw, http.StatusMethodNotAllowed, "method %s is not allowed", req.Method)
+		return
+	}
+	if s.authority == nil {
+		writeError(rw, http.StatusNotFound, "built-in CA is disabled")
+		return
+	}
+
+	n, err := s.authority.RevokeAgent(uuid)
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	res := &RevokeResponse{Revoked: n}
+	if svc := s.registry.Get(uuid); svc != nil {
+		svc.Kick()
+		res.Kicked = true
+	}
+	logrus.Infof("Admin API: revoked %d certificates of agent %q, kicked: %t.", n, uuid, res.Kicked)
+	writeJSON(rw, http.StatusOK, res)
+}
+
+func (s *Server) handleTunnels(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case "GET":
+		res := []Tunnel{}
+		for _, svc := range s.registry.Services() {
+			for _, t := range svc.Tunnels() {
+				res = append(res, convertTunnel(t))
+			}
+		}
+		for _, t := range s.registry.DetachedTunnels() {
+			res = append(res, convertTunnel(t))
+		}
+		writeJSON(rw, http.StatusOK, res)
+
+	case "POST":
+		var r CreateTunnelRequest
+		if err := json.NewDecoder(io.LimitReader(req.Body, maxRequestSize)).Decode(&r); err != nil {
+			writeError(rw, http.StatusBadRequest, "%s", err)
+			return
+		}
+		if r.Dial == "" {
+			writeError(rw, http.StatusBadRequest, "dial address is required")
+			return
+		}
+		var ttl time.Duration
+		if r.TTL != "" {
+			var err error
+			if ttl, err = time.ParseDuration(r.TTL); err != nil || ttl < 0 {
+				writeError(rw, http.StatusBadRequest, "invalid TTL %q", r.TTL)
+				return
+			}
+		}
+		if r.Weight < 0 || r.Weight > maxWeight {
+			writeError(rw, http.StatusBadRequest, "invalid weight %d, should be between 1 and %d", r.Weight, maxWeight)
+			return
+		}
+		svc := s.registry.Get(r.AgentUUID)
+		if svc == nil {
+			writeError(rw, http.StatusNotFound, "agent %q is not connected", r.AgentUUID)
+			return
+		}
+		t, err := svc.OpenTunnel(r.Dial, tunnel.TunnelOptions{
+			TTL:         ttl,
+			Weight:      r.Weight,
+			ServiceType: r.ServiceType,
+			Persistent:  true,
+		})
+		if err != nil {
+			writeError(rw, http.StatusInternalServerError, "%s", err)
+			return
+		}
+		writeJSON(rw, http.StatusCreated, convertTunnel(t))
+
+	default:
+		writeError(rw, http.StatusMethodNotAllowed, "method %s is not allowed", req.Method)
+	}
+}
+
+func (s *Server) handleTunnel(rw http.ResponseWriter, req *http.Request) {
+	id := strings.TrimPrefix(req.URL.Path, "/v1/tunnels/")
+	_, t := s.registry.FindTunnel(id)
+	if t == nil {
+		writeError(rw, http.StatusNotFound, "no such tunnel: %s", id)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		writeJSON(rw, http.StatusOK, convertTunnel(t))
+	case "DELETE":
+		if err := s.registry.DeleteTunnel(id); err != nil {
+			writeError(rw, http.StatusNotFound, "%s", err)
+			return
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(rw, http.StatusMethodNotAllowed, "method %s is not allowed", req.Method)
+	}
+}
+
+func (s *Server) handleTokens(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		writeError(rw, http.StatusMethodNotAllowed, "method %s is not allowed", req.Method)
+		return
+	}
+	if s.authority == nil {
+		writeError(rw, http.StatusNotFound, "built-in CA is disabled")
+		return
+	}
+
+	var r CreateTokenRequest
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxRequestSize)).Decode(&r); err != nil {
+		writeError(rw, http.StatusBadRequest, "%s", err)
+		return
+	}
+	ttl, err := time.ParseDuration(r.TTL)
+	if err != nil || ttl <= 0 {
+		writeError(rw, http.StatusBadRequest, "invalid TTL %q", r.TTL)
+		return
+	}
+
+	token, err := s.authority.CreateToken(ttl)
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	writeJSON(rw, http.StatusCreated, &CreateTokenResponse{
+		Token:     token,
+		ExpiresAt: time.Now().Add(ttl).UTC(),
+	})
+}
+
+func (s *Server) handlePorts(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(rw, http.StatusMethodNotAllowed, "method %s is not allowed", req.Method)
+		return
+	}
+
+	res := []PortAllocation{}
+	if s.allocator != nil {
+		for _, al := range s.allocator.Allocations() {
+			res = append(res, PortAllocation{
+				Port:      al.Port,
+				AgentUUID: al.AgentUUID,
+				Dial:      al.Dial,
+			})
+		}
+	}
+	writeJSON(rw, http.StatusOK, res)
+}
+
+func (s *Server) handlePort(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "DELETE" {
+		writeError(rw, http.StatusMethodNotAllowed, "method %s is not allowed", req.Method)
+		return
+	}
+	if s.allocator == nil {
+		writeError(rw, http.StatusNotFound, "stable tunnel ports are disabled")
+		return
+	}
+
+	port, err := strconv.Atoi(strings.TrimPrefix(req.URL.Path, "/v1/ports/"))
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, "invalid port")
+		return
+	}
+	if err = s.allocator.Release(port); err != nil {
+		writeError(rw, http.StatusNotFound, "%s", err)
+		return
+	}
+	logrus.Infof("Admin API: released port %d.", port)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) handleDrift(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(rw, http.StatusMethodNotAllowed, "method %s is not allowed", req.Method)
+		return
+	}
+	if s.decls == nil {
+		writeError(rw, http.StatusNotFound, "static tunnel declarations are disabled")
+		return
+	}
+
+	res := []Drift{}
+	for _, d := range s.decls.Drift(s.registry) {
+		res = append(res, Drift{
+			AgentUUID: d.AgentUUID,
+			Dial:      d.Dial,
+			State:     d.State,
+			TunnelID:  d.TunnelID,
+			Error:     d.Error,
+		})
+	}
+	writeJSON(rw, http.StatusOK, res)
+}
+
+func (s *Server) handleKnownAgents(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(rw, http.StatusMethodNotAllowed, "method %s is not allowed", req.Method)
+		return
+	}
+	if s.store == nil {
+		writeError(rw, http.StatusNotFound, "state store is disabled")
+		return
+	}
+
+	agents, err := s.store.Agents()
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, "%s", err)
+		return
+	}
+	res := []KnownAgent{}
+	for _, a := range agents {
+		ka := KnownAgent{
+			UUID:        a.UUID,
+			Hostname:    a.Hostname,
+			Labels:      a.Labels,
+			RemoteAddr:  a.RemoteAddr,
+			FirstSeenAt: a.FirstSeenAt.UTC(),
+			LastSeenAt:  a.LastSeenAt.UTC(),
+		}
+		switch svc := s.registry.Get(a.UUID); {
+		case svc != nil:
+			ka.Connected = true
+			ka.Liveness = svc.Liveness()
+		case a.Evicted:
+			ka.Liveness = tunnel.LivenessDead
+		}
+		res = append(res, ka)
+	}
+	writeJSON(rw, http.StatusOK, res)
+}
+
+func (s *Server) handleKnownAgent(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "DELETE" {
+		writeError(rw, http.StatusMethodNotAllowed, "method %s is not allowed", req.Method)
+		return
+	}
+	if s.store == nil {
+		writeError(rw, http.StatusNotFound, "state store is disabled")
+		return
+	}
+
+	uuid := strings.TrimPrefix(req.URL.Path, "/v1/known-agents/")
+	// close detached tunnels first, so they release their ports and can't be attached again
+	if err := s.registry.ForgetAgent(uuid); err != nil {
+		writeError(rw, http.StatusConflict, "%s", err)
+		return
+	}
+	if err := s.store.DeleteAgent(uuid); err != nil {
+		writeError(rw, http.StatusNotFound, "%s", err)
+		return
+	}
+	if s.allocator != nil {
+		// allocations are already deleted from state store, but allocator keeps them in memory,
+		// and may use other storage
+		if err := s.allocator.ReleaseAgent(uuid); err != nil {
+			logrus.Errorf("Failed to release ports of agent %q: %s.", uuid, err)
+		}
+	}
+	logrus.Infof("Admin API: forgot agent %q.", uuid)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func convertAgent(svc *tunnel.Service) Agent {
+	res := Agent{
+		UUID:        svc.UUID(),
+		Hostname:    svc.Hostname(),
+		Labels:      svc.Labels(),
+		AuthMethod:  svc.Identity().Method,
+		RemoteAddr:  svc.RemoteAddr(),
+		ConnectedAt: svc.ConnectedAt().UTC(),
+		SessionID:   svc.SessionID(),
+		Suspended:   svc.Suspended(),
+		Liveness:    svc.Liveness(),
+		MissedPongs: svc.MissedPongs(),
+		LatencyMs:   svc.Latency().Seconds() * 1000,
+		Tunnels:     len(svc.Tunnels()),
+	}
+	if p := svc.LastPong(); !p.IsZero() {
+		p = p.UTC()
+		res.LastPongAt = &p
+	}
+	return res
+}
+
+func convertTunnel(t *tunnel.Tunnel) Tunnel {
+	res := Tunnel{
+		ID:             t.ID(),
+		AgentUUID:      t.AgentUUID(),
+		Listen:         t.Listen(),
+		Dial:           t.Dial(),
+		Weight:         t.Weight(),
+		ServiceType:    t.ServiceType(),
+		Persistent:     t.Persistent(),
+		AgentConnected: t.AgentConnected(),
+		CreatedAt:      t.CreatedAt().UTC(),
+		Conns:          []Conn{},
+	}
+	if e := t.ExpiresAt(); !e.IsZero() {
+		e = e.UTC()
+		res.ExpiresAt = &e
+	}
+	if err, at := t.LastError(); err != nil {
+		at = at.UTC()
+		res.LastError = err.Message
+		res.LastErrorCode = err.Code.String()
+		res.LastErrorAt = &at
+	}
+	if errors := t.Errors(); len(errors) != 0 {
+		res.Errors = make(map[string]int, len(errors))
+		for code, n := range errors {
+			res.Errors[code.String()] = n
+		}
+	}
+	for _, c := range t.Conns() {
+		res.Conns = append(res.Conns, Conn{
+			AgentTunnelID: c.AgentTunnelID,
+			RemoteAddr:    c.RemoteAddr,
+		})
+	}
+	return res
+}
+
+func writeJSON(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		logrus.Error(err)
+	}
+}
+
+func writeError(rw http.ResponseWriter, code int, format string, args ...interface{}) {
+	writeJSON(rw, code, &Error{Error: fmt.Sprintf(format, args...)})
+}
@@ -0,0 +1,145 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package admin
+
+import (
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-gateway/static"
+	"github.com/Percona-Lab/pmm-gateway/tunnel"
+)
+
+const defaultScrapePath = "/metrics"
+
+// PrometheusServer serves Prometheus HTTP service discovery and scrape proxy.
+type PrometheusServer struct {
+	registry *tunnel.Registry
+	decls    *static.Manager
+	mux      *http.ServeMux
+}
+
+// NewPrometheusServer creates a new Prometheus endpoints server for given registry
+// and static tunnel declarations (may be nil).
+func NewPrometheusServer(registry *tunnel.Registry, decls *static.Manager) *PrometheusServer {
+	s := &PrometheusServer{
+		registry: registry,
+		decls:    decls,
+		mux:      http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/v1/targets", s.handleTargets)
+	s.mux.HandleFunc("/agents/", s.handleScrape)
+	return s
+}
+
+// ServeHTTP implements http.Handler.
+func (s *PrometheusServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	s.mux.ServeHTTP(rw, req)
+}
+
+// scrapeAllowed returns true if target may be scraped via agent's session:
+// it should be a loopback address, or a dial address of agent's tunnel or declaration.
+func (s *PrometheusServer) scrapeAllowed(svc *tunnel.Service, target string) bool {
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return true
+	}
+
+	for _, t := range svc.Tunnels() {
+		if t.Dial() == target {
+			return true
+		}
+	}
+	return s.decls != nil && s.decls.Declared(svc, target)
+}
+
+// handleScrape proxies HTTP request to target behind agent, for example, exporter scraped by Prometheus.
+// Query parameters other than target and path are passed to target.
+func (s *PrometheusServer) handleScrape(rw http.ResponseWriter, req *http.Request) {
+	uuid := strings.TrimPrefix(req.URL.Path, "/agents/")
+	if !strings.HasSuffix(uuid, "/scrape") {
+		writeError(rw, http.StatusNotFound, "not found")
+		return
+	}
+	uuid = strings.TrimSuffix(uuid, "/scrape")
+
+	if req.Method != "GET" {
+		writeError(rw, http.StatusMethodNotAllowed, "method %s is not allowed", req.Method)
+		return
+	}
+
+	q := req.URL.Query()
+	target := q.Get("target")
+	if _, _, err := net.SplitHostPort(target); err != nil {
+		writeError(rw, http.StatusBadRequest, "invalid target %q, should be host:port", target)
+		return
+	}
+	path := q.Get("path")
+	if path == "" {
+		path = defaultScrapePath
+	}
+	u, err := url.Parse(path)
+	if err != nil || !strings.HasPrefix(u.Path, "/") || u.Host != "" {
+		writeError(rw, http.StatusBadRequest, "invalid path %q", path)
+		return
+	}
+	q.Del("target")
+	q.Del("path")
+	params := u.Query()
+	for k, vs := range q {
+		for _, v := range vs {
+			params.Add(k, v)
+		}
+	}
+	u.Scheme = "http"
+	u.Host = target
+	u.RawQuery = params.Encode()
+
+	svc := s.registry.Get(uuid)
+	if svc == nil {
+		writeError(rw, http.StatusNotFound, "agent %q is not connected", uuid)
+		return
+	}
+	if !s.scrapeAllowed(svc, target) {
+		writeError(rw, http.StatusForbidden, "target %s is not loopback or tunnel dial address for agent %q", target, uuid)
+		return
+	}
+
+	proxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL = u
+			r.Host = target
+		},
+		Transport: svc.Transport(),
+		ErrorHandler: func(rw http.ResponseWriter, r *http.Request, err error) {
+			logrus.Warnf("Failed to scrape %s via agent %q: %s.", u, uuid, err)
+			writeError(rw, http.StatusBadGateway, "%s", err)
+		},
+	}
+	proxy.ServeHTTP(rw, req)
+}
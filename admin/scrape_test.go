@@ -0,0 +1,89 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package admin
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Percona-Lab/pmm-gateway/static"
+	"github.com/Percona-Lab/pmm-gateway/tunnel"
+)
+
+func TestScrapeAuthorization(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmm-gateway-admin-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "tunnels.json")
+	err = ioutil.WriteFile(path, []byte(`{"tunnels": [{"agent_uuid": "agent1", "dial": "10.0.0.1:9104"}]}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decls, err := static.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registry := tunnel.NewRegistry()
+	svc, disconnect := connect(t, registry, "agent1", "host1")
+	defer disconnect()
+	tun, err := svc.OpenTunnel("10.0.0.1:9100", tunnel.TunnelOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.DeleteTunnel(tun.ID())
+
+	server := NewPrometheusServer(registry, decls)
+	for _, tc := range []struct {
+		method string
+		url    string
+		code   int
+	}{
+		// agent does not respond, so allowed requests fail when context is done
+		{"GET", "/agents/agent1/scrape?target=127.0.0.1:9100", http.StatusBadGateway},
+		{"GET", "/agents/agent1/scrape?target=localhost:9100&path=/metrics%3Fcollect%5B%5D%3Dgc", http.StatusBadGateway},
+		{"GET", "/agents/agent1/scrape?target=[::1]:9100", http.StatusBadGateway},
+		{"GET", "/agents/agent1/scrape?target=10.0.0.1:9100", http.StatusBadGateway},
+		{"GET", "/agents/agent1/scrape?target=10.0.0.1:9104", http.StatusBadGateway},
+
+		{"GET", "/agents/agent1/scrape?target=10.0.0.1:22", http.StatusForbidden},
+		{"GET", "/agents/agent1/scrape?target=10.0.0.2:9100", http.StatusForbidden},
+		{"GET", "/agents/agent1/scrape?target=169.254.169.254:80", http.StatusForbidden},
+		{"GET", "/agents/agent1/scrape?target=127.0.0.1", http.StatusBadRequest},
+		{"GET", "/agents/agent1/scrape?target=127.0.0.1:9100&path=http://10.0.0.2/metrics", http.StatusBadRequest},
+		{"GET", "/agents/agent2/scrape?target=127.0.0.1:9100", http.StatusNotFound},
+		{"GET", "/agents/agent1/metrics?target=127.0.0.1:9100", http.StatusNotFound},
+		{"POST", "/agents/agent1/scrape?target=127.0.0.1:9100", http.StatusMethodNotAllowed},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		req := httptest.NewRequest(tc.method, tc.url, nil).WithContext(ctx)
+		rw := httptest.NewRecorder()
+		server.ServeHTTP(rw, req)
+		cancel()
+		if rw.Code != tc.code {
+			t.Errorf("%s %s: expected %d, got %d: %s", tc.method, tc.url, tc.code, rw.Code, rw.Body)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package admin
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/Percona-Lab/pmm-gateway/tunnel"
+)
+
+// Target labels. Label set of a tunnel does not change while agent reconnects, so series are not split.
+const (
+	LabelAgentUUID   = "agent_uuid"
+	LabelHostname    = "hostname" // the last known hostname for detached tunnels
+	LabelServiceType = "service_type"
+	LabelTunnelID    = "tunnel_id"
+
+	// MetaLabelAgentConnected is "false" for detached tunnels of disconnected agent during grace period.
+	// It is available for relabeling only.
+	MetaLabelAgentConnected = "__meta_pmm_agent_connected"
+)
+
+// TargetGroup is a Prometheus HTTP and file service discovery target group.
+// Each tunnel is a separate group with its listen address as a single target.
+type TargetGroup struct {
+	Targets []string          `json:"targets"`
+	Labels  map[string]string `json:"labels"`
+}
+
+// TargetGroups returns target groups for all tunnels, including detached ones, or only for tunnels
+// with given service type if it is not empty.
+func TargetGroups(registry *tunnel.Registry, serviceType string) []TargetGroup {
+	res := []TargetGroup{}
+	add := func(t *tunnel.Tunnel, svc *tunnel.Service) {
+		if serviceType != "" && t.ServiceType() != serviceType {
+			return
+		}
+
+		labels := map[string]string{
+			LabelAgentUUID:          t.AgentUUID(),
+			LabelTunnelID:           t.ID(),
+			MetaLabelAgentConnected: strconv.FormatBool(svc != nil),
+		}
+		if h := t.Hostname(); h != "" {
+			labels[LabelHostname] = h
+		}
+		if st := t.ServiceType(); st != "" {
+			labels[LabelServiceType] = st
+		}
+		res = append(res, TargetGroup{
+			Targets: []string{t.Listen()},
+			Labels:  labels,
+		})
+	}
+
+	for _, svc := range registry.Services() {
+		for _, t := range svc.Tunnels() {
+			add(t, svc)
+		}
+	}
+	for _, t := range registry.DetachedTunnels() {
+		add(t, nil)
+	}
+	return res
+}
+
+// handleTargets serves Prometheus HTTP service discovery.
+// Optional service_type query parameter limits targets to tunnels with that service type.
+func (s *PrometheusServer) handleTargets(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		writeError(rw, http.StatusMethodNotAllowed, "method %s is not allowed", req.Method)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, TargetGroups(s.registry, req.URL.Query().Get("service_type")))
+}
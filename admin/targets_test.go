@@ -0,0 +1,118 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Percona-Lab/wsrpc"
+
+	"github.com/Percona-Lab/pmm-gateway/auth"
+	"github.com/Percona-Lab/pmm-gateway/tunnel"
+)
+
+// connect registers a new service for connected agent, and returns it with a function which disconnects agent.
+func connect(t *testing.T, registry *tunnel.Registry, uuid, hostname string) (*tunnel.Service, func()) {
+	t.Helper()
+
+	gwConns := make(chan *wsrpc.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, err := wsrpc.Upgrade(rw, req, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		gwConns <- conn
+	}))
+	agentConn, _, err := wsrpc.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	agentConn.SetFrameHandler(func(*wsrpc.Frame) {})
+	gwConn := <-gwConns
+
+	svc := tunnel.NewService(&auth.Identity{AgentUUID: uuid}, "test", gwConn, registry, tunnel.Config{Hostname: hostname})
+	if err = registry.Add(svc); err != nil {
+		t.Fatal(err)
+	}
+	return svc, func() {
+		svc.Close()
+		registry.Remove(svc)
+		agentConn.Close()
+		gwConn.Close()
+		server.Close()
+	}
+}
+
+func TestTargetGroups(t *testing.T) {
+	registry := tunnel.NewRegistry()
+	registry.SetGracePeriod(time.Minute, time.Second)
+	svc, disconnect := connect(t, registry, "agent1", "host1")
+	mysql, err := svc.OpenTunnel("127.0.0.1:3306", tunnel.TunnelOptions{ServiceType: "mysql"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.DeleteTunnel(mysql.ID())
+	other, err := svc.OpenTunnel("127.0.0.1:9100", tunnel.TunnelOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer registry.DeleteTunnel(other.ID())
+
+	expected := func(t *tunnel.Tunnel, serviceType, connected string) TargetGroup {
+		labels := map[string]string{
+			LabelAgentUUID:          "agent1",
+			LabelHostname:           "host1",
+			LabelTunnelID:           t.ID(),
+			MetaLabelAgentConnected: connected,
+		}
+		if serviceType != "" {
+			labels[LabelServiceType] = serviceType
+		}
+		return TargetGroup{Targets: []string{t.Listen()}, Labels: labels}
+	}
+
+	// detached tunnels keep the same labels, except meta ones
+	for _, connected := range []string{"true", "false"} {
+		if connected == "false" {
+			disconnect()
+		}
+
+		for _, tc := range []struct {
+			serviceType string
+			expected    []TargetGroup
+		}{
+			{"", []TargetGroup{expected(mysql, "mysql", connected), expected(other, "", connected)}},
+			{"mysql", []TargetGroup{expected(mysql, "mysql", connected)}},
+			{"postgresql", []TargetGroup{}},
+		} {
+			actual := TargetGroups(registry, tc.serviceType)
+			if tc.serviceType == "" && len(actual) == 2 && actual[0].Labels[LabelTunnelID] != mysql.ID() {
+				actual[0], actual[1] = actual[1], actual[0]
+			}
+			if !reflect.DeepEqual(tc.expected, actual) {
+				t.Errorf("connected %s, service type %q: expected %+v, got %+v", connected, tc.serviceType, tc.expected, actual)
+			}
+		}
+	}
+}
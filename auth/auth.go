@@ -0,0 +1,278 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package auth authenticates agents before WebSocket connection upgrade.
+//
+// Agents connected via TLS listener with verified client certificate are identified by that certificate
+// (see CertificateAgentUUID). Otherwise, two methods are supported:
+//   - bearer token: "Authorization: Bearer <token>", where token is bound to a single agent UUID;
+//   - HMAC: "Authorization: HMAC-SHA256 <hex signature>" with agent UUID and Unix timestamp (in seconds)
+//     passed in headers; signature is HMAC-SHA256 of "<UUID>\n<timestamp>" with shared secret.
+package auth
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// AgentUUIDHeader is HTTP header used by agents to pass their UUID.
+	AgentUUIDHeader = "Pmm-Agent-Uuid"
+
+	// TimestampHeader is HTTP header used by agents to pass Unix timestamp for HMAC signature.
+	TimestampHeader = "Pmm-Agent-Timestamp"
+
+	// HostnameHeader is HTTP header used by agents to pass their hostname. It is informational
+	// and not authenticated.
+	HostnameHeader = "Pmm-Agent-Hostname"
+
+	// LabelsHeader is HTTP header used by agents to pass their labels like "env=prod,dc=eu1".
+	// It is informational and not authenticated.
+	LabelsHeader = "Pmm-Agent-Labels"
+
+	bearerScheme = "Bearer"
+	hmacScheme   = "HMAC-SHA256"
+
+	// DefaultMaxSkew is a default maximal allowed difference between HMAC timestamp and local clock.
+	DefaultMaxSkew = 5 * time.Minute
+)
+
+// Identity represents authenticated agent.
+type Identity struct {
+	AgentUUID string
+	Method    string // "tls", "token", "hmac", or "none"
+}
+
+// Error is returned by Authenticator when request can't be authenticated.
+// Code is HTTP status code to be returned to the client: 401 for missing or invalid credentials,
+// 403 for valid credentials that do not permit the request.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func unauthorized(format string, args ...interface{}) error {
+	return &Error{Code: http.StatusUnauthorized, Message: fmt.Sprintf(format, args...)}
+}
+
+func forbidden(format string, args ...interface{}) error {
+	return &Error{Code: http.StatusForbidden, Message: fmt.Sprintf(format, args...)}
+}
+
+// RevocationList checks if client certificate is revoked.
+type RevocationList interface {
+	IsRevoked(cert *x509.Certificate) bool
+}
+
+// Authenticator checks agent credentials in HTTP request.
+type Authenticator struct {
+	tokens  map[string]string // agent UUID -> token
+	secret  []byte
+	maxSkew time.Duration
+	now     func() time.Time
+	rl      RevocationList
+}
+
+// NewAuthenticator creates a new authenticator.
+// tokens maps agent UUIDs to their bearer tokens, secret is a shared HMAC secret; both may be empty.
+// If both are empty, authentication is disabled and any agent is accepted.
+func NewAuthenticator(tokens map[string]string, secret []byte) *Authenticator {
+	return &Authenticator{
+		tokens:  tokens,
+		secret:  secret,
+		maxSkew: DefaultMaxSkew,
+		now:     time.Now,
+	}
+}
+
+// SetRevocationList sets revocation list consulted for every client certificate.
+// It should be called before Authenticate is used.
+func (a *Authenticator) SetRevocationList(rl RevocationList) {
+	a.rl = rl
+}
+
+// Enabled returns true if authentication is configured.
+func (a *Authenticator) Enabled() bool {
+	return len(a.tokens) != 0 || len(a.secret) != 0
+}
+
+// Authenticate checks credentials in request and returns agent identity, or *Error.
+func (a *Authenticator) Authenticate(req *http.Request) (*Identity, error) {
+	uuid := req.Header.Get(AgentUUIDHeader)
+
+	if req.TLS != nil && len(req.TLS.VerifiedChains) != 0 {
+		cert := req.TLS.VerifiedChains[0][0]
+		if a.rl != nil && a.rl.IsRevoked(cert) {
+			return nil, forbidden("client certificate is revoked")
+		}
+		certUUID := CertificateAgentUUID(cert)
+		if certUUID == "" {
+			return nil, forbidden("client certificate does not contain agent UUID")
+		}
+		if uuid != "" && uuid != certUUID {
+			return nil, forbidden("client certificate is issued for agent %q, not %q", certUUID, uuid)
+		}
+		return &Identity{AgentUUID: certUUID, Method: "tls"}, nil
+	}
+
+	if !a.Enabled() {
+		return &Identity{AgentUUID: uuid, Method: "none"}, nil
+	}
+
+	authz := req.Header.Get("Authorization")
+	if authz == "" {
+		return nil, unauthorized("no credentials")
+	}
+	parts := strings.SplitN(authz, " ", 2)
+	if len(parts) != 2 {
+		return nil, unauthorized("malformed Authorization header")
+	}
+	scheme, cred := parts[0], strings.TrimSpace(parts[1])
+
+	switch {
+	case strings.EqualFold(scheme, bearerScheme) && len(a.tokens) != 0:
+		return a.checkToken(uuid, cred)
+	case strings.EqualFold(scheme, hmacScheme) && len(a.secret) != 0:
+		return a.checkHMAC(uuid, req.Header.Get(TimestampHeader), cred)
+	default:
+		return nil, unauthorized("unsupported authorization scheme %q", scheme)
+	}
+}
+
+func (a *Authenticator) checkToken(uuid, token string) (*Identity, error) {
+	// check all tokens to avoid leaking timing information
+	var found string
+	for agentUUID, t := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			found = agentUUID
+		}
+	}
+	if found == "" {
+		return nil, unauthorized("invalid token")
+	}
+	if uuid != "" && uuid != found {
+		return nil, forbidden("token is not valid for agent %q", uuid)
+	}
+	return &Identity{AgentUUID: found, Method: "token"}, nil
+}
+
+func (a *Authenticator) checkHMAC(uuid, timestamp, signature string) (*Identity, error) {
+	if uuid == "" {
+		return nil, unauthorized("no %s header", AgentUUIDHeader)
+	}
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return nil, unauthorized("invalid %s header", TimestampHeader)
+	}
+	skew := a.now().Sub(time.Unix(sec, 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > a.maxSkew {
+		return nil, unauthorized("timestamp is too far from server time")
+	}
+
+	actual, err := hex.DecodeString(signature)
+	if err != nil {
+		return nil, unauthorized("malformed signature")
+	}
+	if !hmac.Equal(actual, Sign(a.secret, uuid, timestamp)) {
+		return nil, unauthorized("invalid signature")
+	}
+	return &Identity{AgentUUID: uuid, Method: "hmac"}, nil
+}
+
+// Sign returns HMAC-SHA256 signature for given agent UUID and timestamp.
+func Sign(secret []byte, uuid, timestamp string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(uuid + "\n" + timestamp))
+	return h.Sum(nil)
+}
+
+// LoadTokens reads bearer tokens from file. Each non-empty line not starting with # contains
+// agent UUID and token separated by whitespace.
+func LoadTokens(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	defer f.Close()
+
+	tokens := make(map[string]string)
+	s := bufio.NewScanner(f)
+	var line int
+	for s.Scan() {
+		line++
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, errors.Errorf("%s:%d: expected agent UUID and token", path, line)
+		}
+		tokens[fields[0]] = fields[1]
+	}
+	if err = s.Err(); err != nil {
+		return nil, errors.WithStack(err)
+	}
+	return tokens, nil
+}
+
+// LoadToken reads a single bearer token, like admin API token, from file.
+func LoadToken(path string) (string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+	token := strings.TrimSpace(string(b))
+	if token == "" {
+		return "", errors.Errorf("%s: token is empty", path)
+	}
+	return token, nil
+}
+
+// RequireToken returns handler which passes requests with "Authorization: Bearer <token>" header to h,
+// and responds with 401 to other requests.
+func RequireToken(token string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		parts := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], bearerScheme) ||
+			subtle.ConstantTimeCompare([]byte(strings.TrimSpace(parts[1])), []byte(token)) != 1 {
+			rw.Header().Set("WWW-Authenticate", bearerScheme)
+			http.Error(rw, "invalid or missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
@@ -0,0 +1,314 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// revokedSerials is a RevocationList of certificate serial numbers.
+type revokedSerials map[int64]bool
+
+func (r revokedSerials) IsRevoked(cert *x509.Certificate) bool {
+	return r[cert.SerialNumber.Int64()]
+}
+
+func hmacHeader(secret []byte, uuid, timestamp string) string {
+	return hmacScheme + " " + hex.EncodeToString(Sign(secret, uuid, timestamp))
+}
+
+func TestAuthenticate(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	ts := strconv.FormatInt(now.Unix(), 10)
+	secret := []byte("secret")
+	tokens := map[string]string{
+		"uuid1": "token1",
+		"uuid2": "token2",
+	}
+
+	certURI := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		URIs:         []*url.URL{{Scheme: "urn", Opaque: "uuid:uuid1"}},
+	}
+	certCN := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "uuid2"},
+	}
+	certRevoked := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "uuid3"},
+	}
+	certNoUUID := &x509.Certificate{
+		SerialNumber: big.NewInt(4),
+	}
+
+	for _, tc := range []struct {
+		name     string
+		tokens   map[string]string
+		secret   []byte
+		cert     *x509.Certificate
+		headers  map[string]string
+		expected *Identity
+		code     int
+	}{
+		{
+			name:     "disabled",
+			headers:  map[string]string{AgentUUIDHeader: "uuid1"},
+			expected: &Identity{AgentUUID: "uuid1", Method: "none"},
+		}, {
+			name:   "no credentials",
+			tokens: tokens,
+			code:   401,
+		}, {
+			name:    "malformed header",
+			tokens:  tokens,
+			headers: map[string]string{"Authorization": "token1"},
+			code:    401,
+		}, {
+			name:    "unsupported scheme",
+			tokens:  tokens,
+			headers: map[string]string{"Authorization": "Basic dXNlcjpwYXNz"},
+			code:    401,
+		},
+
+		{
+			name:     "token",
+			tokens:   tokens,
+			headers:  map[string]string{"Authorization": "Bearer token1"},
+			expected: &Identity{AgentUUID: "uuid1", Method: "token"},
+		}, {
+			name:     "token with UUID",
+			tokens:   tokens,
+			headers:  map[string]string{"Authorization": "bearer token2", AgentUUIDHeader: "uuid2"},
+			expected: &Identity{AgentUUID: "uuid2", Method: "token"},
+		}, {
+			name:    "token for other UUID",
+			tokens:  tokens,
+			headers: map[string]string{"Authorization": "Bearer token1", AgentUUIDHeader: "uuid2"},
+			code:    403,
+		}, {
+			name:    "invalid token",
+			tokens:  tokens,
+			headers: map[string]string{"Authorization": "Bearer token3"},
+			code:    401,
+		}, {
+			name:    "token without tokens",
+			secret:  secret,
+			headers: map[string]string{"Authorization": "Bearer token1"},
+			code:    401,
+		},
+
+		{
+			name:   "HMAC",
+			secret: secret,
+			headers: map[string]string{
+				"Authorization": hmacHeader(secret, "uuid1", ts),
+				AgentUUIDHeader: "uuid1",
+				TimestampHeader: ts,
+			},
+			expected: &Identity{AgentUUID: "uuid1", Method: "hmac"},
+		}, {
+			name:   "HMAC within skew",
+			secret: secret,
+			headers: map[string]string{
+				"Authorization": hmacHeader(secret, "uuid1", "1499999701"),
+				AgentUUIDHeader: "uuid1",
+				TimestampHeader: "1499999701",
+			},
+			expected: &Identity{AgentUUID: "uuid1", Method: "hmac"},
+		}, {
+			name:   "HMAC timestamp in the past",
+			secret: secret,
+			headers: map[string]string{
+				"Authorization": hmacHeader(secret, "uuid1", "1499999699"),
+				AgentUUIDHeader: "uuid1",
+				TimestampHeader: "1499999699",
+			},
+			code: 401,
+		}, {
+			name:   "HMAC timestamp in the future",
+			secret: secret,
+			headers: map[string]string{
+				"Authorization": hmacHeader(secret, "uuid1", "1500000301"),
+				AgentUUIDHeader: "uuid1",
+				TimestampHeader: "1500000301",
+			},
+			code: 401,
+		}, {
+			name:   "HMAC invalid timestamp",
+			secret: secret,
+			headers: map[string]string{
+				"Authorization": hmacHeader(secret, "uuid1", "now"),
+				AgentUUIDHeader: "uuid1",
+				TimestampHeader: "now",
+			},
+			code: 401,
+		}, {
+			name:   "HMAC without UUID",
+			secret: secret,
+			headers: map[string]string{
+				"Authorization": hmacHeader(secret, "", ts),
+				TimestampHeader: ts,
+			},
+			code: 401,
+		}, {
+			name:   "HMAC signed for other UUID",
+			secret: secret,
+			headers: map[string]string{
+				"Authorization": hmacHeader(secret, "uuid1", ts),
+				AgentUUIDHeader: "uuid2",
+				TimestampHeader: ts,
+			},
+			code: 401,
+		}, {
+			name:   "HMAC with other secret",
+			secret: secret,
+			headers: map[string]string{
+				"Authorization": hmacHeader([]byte("other"), "uuid1", ts),
+				AgentUUIDHeader: "uuid1",
+				TimestampHeader: ts,
+			},
+			code: 401,
+		}, {
+			name:   "HMAC malformed signature",
+			secret: secret,
+			headers: map[string]string{
+				"Authorization": hmacScheme + " xyz",
+				AgentUUIDHeader: "uuid1",
+				TimestampHeader: ts,
+			},
+			code: 401,
+		},
+
+		{
+			name:     "certificate with URI",
+			tokens:   tokens,
+			cert:     certURI,
+			expected: &Identity{AgentUUID: "uuid1", Method: "tls"},
+		}, {
+			name:     "certificate with common name",
+			cert:     certCN,
+			headers:  map[string]string{AgentUUIDHeader: "uuid2"},
+			expected: &Identity{AgentUUID: "uuid2", Method: "tls"},
+		}, {
+			name:    "certificate for other UUID",
+			cert:    certURI,
+			headers: map[string]string{AgentUUIDHeader: "uuid2", "Authorization": "Bearer token2"},
+			tokens:  tokens,
+			code:    403,
+		}, {
+			name: "revoked certificate",
+			cert: certRevoked,
+			code: 403,
+		}, {
+			name: "certificate without UUID",
+			cert: certNoUUID,
+			code: 403,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a := NewAuthenticator(tc.tokens, tc.secret)
+			a.now = func() time.Time { return now }
+			a.SetRevocationList(revokedSerials{3: true})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			for k, v := range tc.headers {
+				req.Header.Set(k, v)
+			}
+			if tc.cert != nil {
+				req.TLS = &tls.ConnectionState{
+					VerifiedChains: [][]*x509.Certificate{{tc.cert}},
+				}
+			}
+
+			identity, err := a.Authenticate(req)
+			if tc.expected != nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if *identity != *tc.expected {
+					t.Errorf("expected %+v, got %+v", *tc.expected, *identity)
+				}
+				return
+			}
+
+			e, ok := err.(*Error)
+			if !ok {
+				t.Fatalf("expected *Error, got %#v", err)
+			}
+			if e.Code != tc.code {
+				t.Errorf("expected code %d, got %d (%s)", tc.code, e.Code, e)
+			}
+			if identity != nil {
+				t.Errorf("expected no identity, got %+v", *identity)
+			}
+		})
+	}
+}
+
+func TestAuthenticateUnverifiedCertificate(t *testing.T) {
+	a := NewAuthenticator(map[string]string{"uuid1": "token1"}, nil)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "uuid1"}}},
+	}
+	_, err := a.Authenticate(req)
+	if e, ok := err.(*Error); !ok || e.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401 error, got %#v", err)
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	h := RequireToken("secret", http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+
+	for _, tc := range []struct {
+		authz    string
+		expected int
+	}{
+		{"Bearer secret", http.StatusNoContent},
+		{"bearer  secret ", http.StatusNoContent},
+		{"", http.StatusUnauthorized},
+		{"Bearer", http.StatusUnauthorized},
+		{"Bearer other", http.StatusUnauthorized},
+		{"Bearer secret2", http.StatusUnauthorized},
+		{"Basic secret", http.StatusUnauthorized},
+	} {
+		t.Run(tc.authz, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/v1/agents", nil)
+			if tc.authz != "" {
+				req.Header.Set("Authorization", tc.authz)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tc.expected {
+				t.Errorf("expected %d, got %d", tc.expected, rec.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package auth
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// uuidURNPrefix is a prefix of URI SAN carrying agent UUID, as in "urn:uuid:f81d4fae-7dec-11d0-a765-00a0c91e6bf6".
+const uuidURNPrefix = "urn:uuid:"
+
+// CertificateAgentUUID returns agent UUID from client certificate:
+// URI SAN "urn:uuid:<UUID>" if present, subject common name otherwise.
+func CertificateAgentUUID(cert *x509.Certificate) string {
+	for _, u := range cert.URIs {
+		if s := u.String(); strings.HasPrefix(strings.ToLower(s), uuidURNPrefix) {
+			return s[len(uuidURNPrefix):]
+		}
+	}
+	return cert.Subject.CommonName
+}
+
+// LoadCertPool reads PEM-encoded certificates from file.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, errors.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// ServerTLSConfig returns TLS configuration for agents listener.
+// If clientCAs is not nil, client certificates are verified against it;
+// if requireClientCert is true, connections without valid client certificate are rejected.
+func ServerTLSConfig(certFile, keyFile string, clientCAs *x509.CertPool, requireClientCert bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load server certificate")
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAs == nil {
+		if requireClientCert {
+			return nil, errors.New("client CA certificates are required to verify client certificates")
+		}
+		return config, nil
+	}
+
+	config.ClientCAs = clientCAs
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if requireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
@@ -0,0 +1,464 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package ca implements a small certificate authority issuing short-lived client certificates for agents.
+//
+// Agent enrolls with a one-time registration token and a CSR, and receives a certificate bound to a new agent UUID
+// (see auth.CertificateAgentUUID). Before that certificate expires, agent renews it by sending a new CSR over
+// TLS connection authenticated by the current certificate. Revoked certificates are rejected on every connection.
+package ca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	caCertFile = "ca.pem"
+	caKeyFile  = "ca-key.pem"
+	stateFile  = "state.json"
+
+	caTTL = 10 * 365 * 24 * time.Hour
+
+	// clock skew tolerance for issued certificates
+	notBeforeSkew = 5 * time.Minute
+)
+
+// Token represents registration token information.
+type Token struct {
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Issued represents issued certificate information.
+type Issued struct {
+	AgentUUID string    `json:"agent_uuid"`
+	NotAfter  time.Time `json:"not_after"`
+	RevokedAt time.Time `json:"revoked_at,omitempty"`
+}
+
+// state is persisted CA state.
+type state struct {
+	Tokens map[string]*Token  `json:"tokens"` // SHA-256 of token -> token
+	Issued map[string]*Issued `json:"issued"` // certificate serial number (hex) -> info
+}
+
+// Storage persists CA state: registration tokens and issued certificates information.
+type Storage interface {
+	// LoadCAState returns the saved state, or nil if there is none.
+	LoadCAState() ([]byte, error)
+
+	// SaveCAState saves state.
+	SaveCAState(b []byte) error
+}
+
+// fileStorage stores CA state in a file.
+type fileStorage string
+
+func (path fileStorage) LoadCAState() ([]byte, error) {
+	b, err := ioutil.ReadFile(string(path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return b, errors.WithStack(err)
+}
+
+func (path fileStorage) SaveCAState(b []byte) error {
+	if err := ioutil.WriteFile(string(path)+".tmp", b, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(string(path)+".tmp", string(path)))
+}
+
+// CA is a certificate authority for agents.
+type CA struct {
+	dir     string
+	certTTL time.Duration
+	storage Storage
+
+	cert    *x509.Certificate
+	certPEM []byte
+	key     *ecdsa.PrivateKey
+
+	rw    sync.RWMutex
+	state *state
+}
+
+// New loads CA from given directory, creating a new CA key and certificate if they don't exist.
+// Issued certificates are valid for certTTL. If storage is nil, state is stored in the same directory.
+// Otherwise, state is stored in given storage; if it is empty, state is migrated from the directory.
+func New(dir string, certTTL time.Duration, storage Storage) (*CA, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	file := fileStorage(filepath.Join(dir, stateFile))
+	if storage == nil {
+		storage = file
+	}
+	ca := &CA{
+		dir:     dir,
+		certTTL: certTTL,
+		storage: storage,
+		state: &state{
+			Tokens: make(map[string]*Token),
+			Issued: make(map[string]*Issued),
+		},
+	}
+	if err := ca.loadOrCreateKeyPair(); err != nil {
+		return nil, err
+	}
+
+	b, err := storage.LoadCAState()
+	if err == nil && b == nil && storage != file {
+		b, err = file.LoadCAState()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if b != nil {
+		if err = json.Unmarshal(b, ca.state); err != nil {
+			return nil, errors.Wrap(err, "failed to parse CA state")
+		}
+	}
+	return ca, nil
+}
+
+func (ca *CA) loadOrCreateKeyPair() error {
+	certPath, keyPath := filepath.Join(ca.dir, caCertFile), filepath.Join(ca.dir, caKeyFile)
+	certPEM, err := ioutil.ReadFile(certPath)
+	if os.IsNotExist(err) {
+		return ca.createKeyPair(certPath, keyPath)
+	}
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return errors.Errorf("no certificate found in %s", certPath)
+	}
+	if ca.cert, err = x509.ParseCertificate(block.Bytes); err != nil {
+		return errors.WithStack(err)
+	}
+	if block, _ = pem.Decode(keyPEM); block == nil {
+		return errors.Errorf("no key found in %s", keyPath)
+	}
+	if ca.key, err = x509.ParseECPrivateKey(block.Bytes); err != nil {
+		return errors.WithStack(err)
+	}
+	ca.certPEM = certPEM
+	return nil
+}
+
+func (ca *CA) createKeyPair(certPath, keyPath string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	serial, err := newSerial()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "pmm-gateway CA"},
+		NotBefore:             now.Add(-notBeforeSkew),
+		NotAfter:              now.Add(caTTL),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if ca.cert, err = x509.ParseCertificate(der); err != nil {
+		return errors.WithStack(err)
+	}
+	ca.key = key
+	ca.certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err = ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(ioutil.WriteFile(certPath, ca.certPEM, 0644))
+}
+
+// saveState writes state to storage. Caller must hold write lock.
+func (ca *CA) saveState() error {
+	b, err := json.MarshalIndent(ca.state, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return ca.storage.SaveCAState(b)
+}
+
+// CertificatePEM returns CA certificate in PEM format.
+func (ca *CA) CertificatePEM() []byte {
+	return ca.certPEM
+}
+
+// Certificate returns CA certificate.
+func (ca *CA) Certificate() *x509.Certificate {
+	return ca.cert
+}
+
+// CreateToken creates a new one-time registration token valid for ttl.
+func (ca *CA) CreateToken(ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.WithStack(err)
+	}
+	token := hex.EncodeToString(b)
+
+	ca.rw.Lock()
+	defer ca.rw.Unlock()
+
+	ca.state.Tokens[hashToken(token)] = &Token{ExpiresAt: time.Now().Add(ttl)}
+	if err := ca.saveState(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// Enroll checks registration token, issues a new certificate for a new agent UUID, and consumes token.
+// Token is not consumed if certificate can't be issued.
+// It returns agent UUID and certificate in PEM format.
+func (ca *CA) Enroll(token string, csrPEM []byte) (string, []byte, error) {
+	csr, err := parseCSR(csrPEM)
+	if err != nil {
+		return "", nil, err
+	}
+
+	ca.rw.Lock()
+	defer ca.rw.Unlock()
+
+	h := hashToken(token)
+	t := ca.state.Tokens[h]
+	if t == nil {
+		return "", nil, errors.New("invalid registration token")
+	}
+	if time.Now().After(t.ExpiresAt) {
+		delete(ca.state.Tokens, h)
+		if err = ca.saveState(); err != nil {
+			return "", nil, err
+		}
+		return "", nil, errors.New("registration token expired")
+	}
+
+	uuid, err := newUUID()
+	if err != nil {
+		return "", nil, err
+	}
+	certPEM, err := ca.issue(uuid, csr, h)
+	if err != nil {
+		return "", nil, err
+	}
+	return uuid, certPEM, nil
+}
+
+// Renew issues a new certificate for the same agent as current one.
+// Current certificate should be already verified by TLS handshake; it is checked again anyway.
+func (ca *CA) Renew(current *x509.Certificate, csrPEM []byte) ([]byte, error) {
+	csr, err := parseCSR(csrPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	if current.CheckSignatureFrom(ca.cert) != nil {
+		return nil, errors.New("certificate was not issued by this CA")
+	}
+	now := time.Now()
+	if now.Before(current.NotBefore) {
+		return nil, errors.New("certificate is not valid yet")
+	}
+	if now.After(current.NotAfter) {
+		return nil, errors.New("certificate expired")
+	}
+
+	ca.rw.Lock()
+	defer ca.rw.Unlock()
+
+	issued := ca.state.Issued[serialString(current.SerialNumber)]
+	if issued == nil {
+		return nil, errors.New("certificate was not issued by this CA")
+	}
+	if !issued.RevokedAt.IsZero() {
+		return nil, errors.New("certificate is revoked")
+	}
+	return ca.issue(issued.AgentUUID, csr, "")
+}
+
+// issue signs a new certificate for given agent, and consumes registration token with given hash, if any.
+// State is not changed if it can't be saved. Caller must hold write lock.
+func (ca *CA) issue(uuid string, csr *x509.CertificateRequest, tokenHash string) ([]byte, error) {
+	serial, err := newSerial()
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse("urn:uuid:" + uuid)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: uuid},
+		URIs:         []*url.URL{u},
+		NotBefore:    now.Add(-notBeforeSkew),
+		NotAfter:     now.Add(ca.certTTL),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, csr.PublicKey, ca.key)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	s := serialString(serial)
+	ca.state.Issued[s] = &Issued{
+		AgentUUID: uuid,
+		NotAfter:  template.NotAfter,
+	}
+	token := ca.state.Tokens[tokenHash]
+	delete(ca.state.Tokens, tokenHash)
+	ca.expire(now)
+	if err = ca.saveState(); err != nil {
+		delete(ca.state.Issued, s)
+		if token != nil {
+			ca.state.Tokens[tokenHash] = token
+		}
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), nil
+}
+
+// expire removes expired tokens and certificates from state. Caller must hold write lock.
+func (ca *CA) expire(now time.Time) {
+	for h, t := range ca.state.Tokens {
+		if now.After(t.ExpiresAt) {
+			delete(ca.state.Tokens, h)
+		}
+	}
+	for s, i := range ca.state.Issued {
+		if now.After(i.NotAfter) {
+			delete(ca.state.Issued, s)
+		}
+	}
+}
+
+// RevokeAgent revokes all certificates issued for given agent.
+// It returns the number of revoked certificates.
+func (ca *CA) RevokeAgent(uuid string) (int, error) {
+	ca.rw.Lock()
+	defer ca.rw.Unlock()
+
+	var n int
+	now := time.Now()
+	for _, i := range ca.state.Issued {
+		if i.AgentUUID == uuid && i.RevokedAt.IsZero() {
+			i.RevokedAt = now
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, ca.saveState()
+}
+
+// IsRevoked returns true if certificate was issued by this CA and then revoked,
+// or if it is not known to this CA while being signed by it.
+func (ca *CA) IsRevoked(cert *x509.Certificate) bool {
+	if cert.CheckSignatureFrom(ca.cert) != nil {
+		// issued by other CA, not our business
+		return false
+	}
+
+	ca.rw.RLock()
+	defer ca.rw.RUnlock()
+
+	issued := ca.state.Issued[serialString(cert.SerialNumber)]
+	return issued == nil || !issued.RevokedAt.IsZero()
+}
+
+func parseCSR(csrPEM []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(csrPEM)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, errors.New("no certificate request found")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return nil, errors.Wrap(err, "invalid certificate request signature")
+	}
+	return csr, nil
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func newSerial() (*big.Int, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return serial, errors.WithStack(err)
+}
+
+func serialString(serial *big.Int) string {
+	return serial.Text(16)
+}
+
+// newUUID returns random (version 4) UUID.
+func newUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.WithStack(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
@@ -0,0 +1,326 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package ca
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Percona-Lab/pmm-gateway/auth"
+)
+
+func newTestCA(t *testing.T) (*CA, func()) {
+	dir, err := ioutil.TempDir("", "pmm-gateway-ca-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := New(dir, time.Hour, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return ca, func() { os.RemoveAll(dir) }
+}
+
+func newCSR(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+}
+
+func parseCert(t *testing.T, certPEM []byte) *x509.Certificate {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		t.Fatalf("no certificate found in %q", certPEM)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// enroll creates token and enrolls a new agent.
+func enroll(t *testing.T, ca *CA) (string, *x509.Certificate) {
+	token, err := ca.CreateToken(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuid, certPEM, err := ca.Enroll(token, newCSR(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uuid, parseCert(t, certPEM)
+}
+
+func expectError(t *testing.T, err error, expected string) {
+	t.Helper()
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestEnroll(t *testing.T) {
+	ca, cleanup := newTestCA(t)
+	defer cleanup()
+
+	token, err := ca.CreateToken(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuid, certPEM, err := ca.Enroll(token, newCSR(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := parseCert(t, certPEM)
+	if err = cert.CheckSignatureFrom(ca.Certificate()); err != nil {
+		t.Error(err)
+	}
+	if u := auth.CertificateAgentUUID(cert); u != uuid {
+		t.Errorf("expected certificate for %q, got %q", uuid, u)
+	}
+	if ca.IsRevoked(cert) {
+		t.Error("new certificate is revoked")
+	}
+
+	t.Run("TokenIsConsumed", func(t *testing.T) {
+		_, _, err := ca.Enroll(token, newCSR(t))
+		expectError(t, err, "invalid registration token")
+	})
+
+	t.Run("InvalidCSR", func(t *testing.T) {
+		token, err := ca.CreateToken(time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _, err = ca.Enroll(token, certPEM)
+		expectError(t, err, "no certificate request found")
+
+		// token is not consumed by invalid request
+		if _, _, err = ca.Enroll(token, newCSR(t)); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// failingStorage keeps CA state in memory, and fails to save it when fail is true.
+type failingStorage struct {
+	b    []byte
+	fail bool
+}
+
+func (s *failingStorage) LoadCAState() ([]byte, error) {
+	return s.b, nil
+}
+
+func (s *failingStorage) SaveCAState(b []byte) error {
+	if s.fail {
+		return errors.New("storage failure")
+	}
+	s.b = b
+	return nil
+}
+
+func TestEnrollStorageFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmm-gateway-ca-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage := new(failingStorage)
+	ca, err := New(dir, time.Hour, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := ca.CreateToken(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.fail = true
+	_, _, err = ca.Enroll(token, newCSR(t))
+	expectError(t, err, "storage failure")
+	if len(ca.state.Issued) != 0 {
+		t.Errorf("certificate is recorded: %v", ca.state.Issued)
+	}
+
+	// token is not consumed
+	storage.fail = false
+	if _, _, err = ca.Enroll(token, newCSR(t)); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ca.Enroll(token, newCSR(t))
+	expectError(t, err, "invalid registration token")
+}
+
+func TestEnrollExpiredToken(t *testing.T) {
+	ca, cleanup := newTestCA(t)
+	defer cleanup()
+
+	token, err := ca.CreateToken(-time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = ca.Enroll(token, newCSR(t))
+	expectError(t, err, "registration token expired")
+
+	// expired token is removed
+	_, _, err = ca.Enroll(token, newCSR(t))
+	expectError(t, err, "invalid registration token")
+}
+
+func TestRenew(t *testing.T) {
+	ca, cleanup := newTestCA(t)
+	defer cleanup()
+
+	uuid, cert := enroll(t, ca)
+	certPEM, err := ca.Renew(cert, newCSR(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	renewed := parseCert(t, certPEM)
+	if u := auth.CertificateAgentUUID(renewed); u != uuid {
+		t.Errorf("expected certificate for %q, got %q", uuid, u)
+	}
+	if renewed.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+		t.Error("renewed certificate has the same serial number")
+	}
+
+	t.Run("Revoked", func(t *testing.T) {
+		n, err := ca.RevokeAgent(uuid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != 2 {
+			t.Errorf("expected 2 revoked certificates, got %d", n)
+		}
+		for _, c := range []*x509.Certificate{cert, renewed} {
+			if !ca.IsRevoked(c) {
+				t.Errorf("certificate %s is not revoked", c.SerialNumber)
+			}
+		}
+		_, err = ca.Renew(renewed, newCSR(t))
+		expectError(t, err, "certificate is revoked")
+
+		// revocation is persisted
+		reloaded, err := New(ca.dir, time.Hour, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reloaded.IsRevoked(renewed) {
+			t.Error("revocation is not persisted")
+		}
+	})
+
+	t.Run("Unknown", func(t *testing.T) {
+		_, cert := enroll(t, ca)
+		ca.rw.Lock()
+		delete(ca.state.Issued, serialString(cert.SerialNumber))
+		ca.rw.Unlock()
+
+		_, err := ca.Renew(cert, newCSR(t))
+		expectError(t, err, "certificate was not issued by this CA")
+		if !ca.IsRevoked(cert) {
+			t.Error("unknown certificate signed by CA is not revoked")
+		}
+	})
+}
+
+// signCert signs agent certificate with given serial number and validity period by CA.
+func signCert(t *testing.T, ca *CA, serial *big.Int, notBefore, notAfter time.Time) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestRenewChecks(t *testing.T) {
+	ca, cleanup := newTestCA(t)
+	defer cleanup()
+	other, otherCleanup := newTestCA(t)
+	defer otherCleanup()
+
+	_, cert := enroll(t, ca)
+	now := time.Now()
+	for _, tc := range []struct {
+		name     string
+		cert     *x509.Certificate
+		expected string
+	}{
+		// the same serial number as a certificate issued by this CA
+		{"OtherCA", signCert(t, other, cert.SerialNumber, now.Add(-time.Hour), now.Add(time.Hour)), "certificate was not issued by this CA"},
+		{"Expired", signCert(t, ca, cert.SerialNumber, now.Add(-2*time.Hour), now.Add(-time.Hour)), "certificate expired"},
+		{"NotValidYet", signCert(t, ca, cert.SerialNumber, now.Add(time.Hour), now.Add(2*time.Hour)), "certificate is not valid yet"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ca.Renew(tc.cert, newCSR(t))
+			expectError(t, err, tc.expected)
+		})
+	}
+}
+
+func TestIsRevokedOtherCA(t *testing.T) {
+	ca, cleanup := newTestCA(t)
+	defer cleanup()
+	other, otherCleanup := newTestCA(t)
+	defer otherCleanup()
+
+	uuid, cert := enroll(t, other)
+	if ca.IsRevoked(cert) {
+		t.Error("certificate signed by other CA is revoked")
+	}
+	_, err := ca.Renew(cert, newCSR(t))
+	expectError(t, err, "certificate was not issued by this CA")
+
+	// revocation by other CA does not matter
+	if _, err = other.RevokeAgent(uuid); err != nil {
+		t.Fatal(err)
+	}
+	if ca.IsRevoked(cert) {
+		t.Error("certificate signed by other CA is revoked")
+	}
+}
@@ -0,0 +1,112 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package ca
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-gateway/auth"
+)
+
+// maxRequestSize limits enrollment and renewal request body size.
+const maxRequestSize = 64 * 1024
+
+// EnrollRequest is a body of enrollment and renewal requests.
+type EnrollRequest struct {
+	Token string `json:"token,omitempty"` // not used for renewal
+	CSR   string `json:"csr"`             // PEM-encoded
+}
+
+// EnrollResponse is a body of enrollment and renewal responses.
+type EnrollResponse struct {
+	AgentUUID     string `json:"agent_uuid"`
+	Certificate   string `json:"certificate"`    // PEM-encoded
+	CACertificate string `json:"ca_certificate"` // PEM-encoded
+}
+
+// EnrollHandler returns HTTP handler for enrollment requests.
+func (ca *CA) EnrollHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		var r EnrollRequest
+		if !readRequest(rw, req, &r) {
+			return
+		}
+
+		uuid, certPEM, err := ca.Enroll(r.Token, []byte(r.CSR))
+		if err != nil {
+			logrus.Warnf("Enrollment from %s failed: %s.", req.RemoteAddr, err)
+			http.Error(rw, err.Error(), http.StatusForbidden)
+			return
+		}
+		logrus.Infof("Agent %s enrolled from %s.", uuid, req.RemoteAddr)
+		ca.writeResponse(rw, uuid, certPEM)
+	})
+}
+
+// RenewHandler returns HTTP handler for renewal requests.
+// They should be made over TLS connection with current client certificate.
+func (ca *CA) RenewHandler() http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 {
+			http.Error(rw, "valid client certificate is required", http.StatusUnauthorized)
+			return
+		}
+		var r EnrollRequest
+		if !readRequest(rw, req, &r) {
+			return
+		}
+
+		current := req.TLS.VerifiedChains[0][0]
+		certPEM, err := ca.Renew(current, []byte(r.CSR))
+		if err != nil {
+			logrus.Warnf("Renewal from %s failed: %s.", req.RemoteAddr, err)
+			http.Error(rw, err.Error(), http.StatusForbidden)
+			return
+		}
+		uuid := auth.CertificateAgentUUID(current)
+		logrus.Infof("Agent %s renewed certificate from %s.", uuid, req.RemoteAddr)
+		ca.writeResponse(rw, uuid, certPEM)
+	})
+}
+
+func readRequest(rw http.ResponseWriter, req *http.Request, r *EnrollRequest) bool {
+	if req.Method != "POST" {
+		http.Error(rw, "POST is expected", http.StatusMethodNotAllowed)
+		return false
+	}
+	if err := json.NewDecoder(io.LimitReader(req.Body, maxRequestSize)).Decode(r); err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (ca *CA) writeResponse(rw http.ResponseWriter, uuid string, certPEM []byte) {
+	rw.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(rw).Encode(&EnrollResponse{
+		AgentUUID:     uuid,
+		Certificate:   string(certPEM),
+		CACertificate: string(ca.certPEM),
+	})
+	if err != nil {
+		logrus.Error(err)
+	}
+}
@@ -0,0 +1,273 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/Percona-Lab/pmm-gateway/admin"
+	"github.com/Percona-Lab/pmm-gateway/auth"
+)
+
+var (
+	adminAddressF = kingpin.Flag("admin-address", "Admin API address of running gateway").Default(defaultAdminAddress).String()
+	formatF       = kingpin.Flag("format", "Output format").Default("table").Enum("table", "json")
+
+	agentsCmd       = kingpin.Command("agents", "Manage connected agents")
+	agentsListCmd   = agentsCmd.Command("list", "List connected agents")
+	agentsPingCmd   = agentsCmd.Command("ping", "Ping agent")
+	agentsPingF     = agentsPingCmd.Arg("uuid", "Agent UUID").Required().String()
+	agentsKickCmd   = agentsCmd.Command("kick", "Close agent session")
+	agentsKickF     = agentsKickCmd.Arg("uuid", "Agent UUID").Required().String()
+	agentsRevokeCmd = agentsCmd.Command("revoke", "Revoke agent's certificates issued by built-in CA and close its session")
+	agentsRevokeF   = agentsRevokeCmd.Arg("uuid", "Agent UUID").Required().String()
+
+	agentsKnownCmd  = agentsCmd.Command("known", "List agents known to state store")
+	agentsForgetCmd = agentsCmd.Command("forget", "Forget disconnected agent, its persistent tunnels and port allocations")
+	agentsForgetF   = agentsForgetCmd.Arg("uuid", "Agent UUID").Required().String()
+
+	tunnelsCmd           = kingpin.Command("tunnels", "Manage tunnels")
+	tunnelsListCmd       = tunnelsCmd.Command("list", "List tunnels")
+	tunnelsCreateCmd     = tunnelsCmd.Command("create", "Create tunnel")
+	tunnelsCreateAgentF  = tunnelsCreateCmd.Flag("agent", "Agent UUID").Required().String()
+	tunnelsCreateDialF   = tunnelsCreateCmd.Flag("dial", "Address dialed by agent").Required().String()
+	tunnelsCreateTTLF    = tunnelsCreateCmd.Flag("ttl", "Delete tunnel automatically after that time (0 for never)").Duration()
+	tunnelsCreateWeightF = tunnelsCreateCmd.Flag("weight", "Share of agent's connection relative to other tunnels").Default("1").Int()
+	tunnelsCreateTypeF   = tunnelsCreateCmd.Flag("service-type", "Type of service behind tunnel for service discovery, like node_exporter").String()
+	tunnelsCloseCmd      = tunnelsCmd.Command("close", "Close tunnel and all its connections")
+	tunnelsCloseF        = tunnelsCloseCmd.Arg("id", "Tunnel ID").Required().String()
+	tunnelsDriftCmd      = tunnelsCmd.Command("drift", "Show differences between declared and actual tunnels")
+
+	portsCmd        = kingpin.Command("ports", "Manage stable tunnel port allocations")
+	portsListCmd    = portsCmd.Command("list", "List port allocations")
+	portsReleaseCmd = portsCmd.Command("release", "Release port allocation")
+	portsReleaseF   = portsReleaseCmd.Arg("port", "Port").Required().Int()
+
+	tokensCmd       = kingpin.Command("enrollment-tokens", "Manage built-in CA registration tokens")
+	tokensCreateCmd = tokensCmd.Command("create", "Create one-time registration token")
+	tokensCreateF   = tokensCreateCmd.Flag("ttl", "Token validity period").Default("1h").Duration()
+)
+
+// call makes admin API request and decodes response into res (which may be nil).
+func call(method, path string, body, res interface{}) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		kingpin.FatalIfError(err, "failed to marshal request")
+		r = bytes.NewReader(b)
+	}
+
+	u := *adminAddressF
+	if !strings.Contains(u, "://") {
+		u = "http://" + u
+	}
+	req, err := http.NewRequest(method, u+path, r)
+	kingpin.FatalIfError(err, "failed to create request")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if *adminTokenFileF != "" {
+		token, err := auth.LoadToken(*adminTokenFileF)
+		kingpin.FatalIfError(err, "failed to load admin API token")
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	kingpin.FatalIfError(err, "failed to connect to gateway")
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		var e admin.Error
+		if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Error == "" {
+			e.Error = resp.Status
+		}
+		kingpin.Fatalf("%s", e.Error)
+	}
+	if res != nil {
+		kingpin.FatalIfError(json.NewDecoder(resp.Body).Decode(res), "failed to decode response")
+	}
+}
+
+// output prints v as JSON if requested; otherwise, it calls table with tabwriter.
+func output(v interface{}, table func(w io.Writer)) {
+	if *formatF == "json" {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "  ")
+		kingpin.FatalIfError(e.Encode(v), "failed to encode output")
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	table(w)
+	w.Flush()
+}
+
+func runAgentsList() {
+	var agents []admin.Agent
+	call("GET", "/v1/agents", nil, &agents)
+	output(agents, func(w io.Writer) {
+		fmt.Fprintln(w, "UUID\tHOSTNAME\tAUTH\tREMOTE ADDRESS\tCONNECTED\tLIVENESS\tLATENCY\tTUNNELS")
+		for _, a := range agents {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\n", a.UUID, formatEmpty(a.Hostname), a.AuthMethod, a.RemoteAddr,
+				a.ConnectedAt.Local().Format(time.RFC3339), a.Liveness, formatLatency(a.LatencyMs), a.Tunnels)
+		}
+	})
+}
+
+func runAgentsPing() {
+	var res admin.PingResponse
+	call("POST", "/v1/agents/"+url.PathEscape(*agentsPingF)+"/ping", nil, &res)
+	output(res, func(w io.Writer) {
+		fmt.Fprintf(w, "%s: %s\n", *agentsPingF, formatLatency(res.LatencyMs))
+	})
+}
+
+func runAgentsKick() {
+	call("DELETE", "/v1/agents/"+url.PathEscape(*agentsKickF), nil, nil)
+}
+
+func runAgentsRevoke() {
+	var res admin.RevokeResponse
+	call("POST", "/v1/agents/"+url.PathEscape(*agentsRevokeF)+"/revoke", nil, &res)
+	output(res, func(w io.Writer) {
+		fmt.Fprintf(w, "%s: %d certificates revoked", *agentsRevokeF, res.Revoked)
+		if res.Kicked {
+			fmt.Fprint(w, ", session closed")
+		}
+		fmt.Fprintln(w)
+	})
+}
+
+func runAgentsKnown() {
+	var agents []admin.KnownAgent
+	call("GET", "/v1/known-agents", nil, &agents)
+	output(agents, func(w io.Writer) {
+		fmt.Fprintln(w, "UUID\tHOSTNAME\tREMOTE ADDRESS\tFIRST SEEN\tLAST SEEN\tCONNECTED\tLIVENESS")
+		for _, a := range agents {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%t\t%s\n", a.UUID, formatEmpty(a.Hostname), a.RemoteAddr,
+				a.FirstSeenAt.Local().Format(time.RFC3339), a.LastSeenAt.Local().Format(time.RFC3339), a.Connected,
+				formatEmpty(a.Liveness))
+		}
+	})
+}
+
+func runAgentsForget() {
+	call("DELETE", "/v1/known-agents/"+url.PathEscape(*agentsForgetF), nil, nil)
+}
+
+func runTunnelsList() {
+	var tunnels []admin.Tunnel
+	call("GET", "/v1/tunnels", nil, &tunnels)
+	output(tunnels, func(w io.Writer) {
+		fmt.Fprintln(w, "ID\tAGENT\tLISTEN\tDIAL\tSERVICE\tWEIGHT\tCREATED\tEXPIRES\tCONNECTIONS")
+		for _, t := range tunnels {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\t%d\n", t.ID, t.AgentUUID, t.Listen, t.Dial, formatEmpty(t.ServiceType), t.Weight,
+				t.CreatedAt.Local().Format(time.RFC3339), formatExpires(t.ExpiresAt), len(t.Conns))
+		}
+	})
+}
+
+func runTunnelsCreate() {
+	req := &admin.CreateTunnelRequest{
+		AgentUUID:   *tunnelsCreateAgentF,
+		Dial:        *tunnelsCreateDialF,
+		Weight:      *tunnelsCreateWeightF,
+		ServiceType: *tunnelsCreateTypeF,
+	}
+	if *tunnelsCreateTTLF != 0 {
+		req.TTL = tunnelsCreateTTLF.String()
+	}
+	var t admin.Tunnel
+	call("POST", "/v1/tunnels", req, &t)
+	output(t, func(w io.Writer) {
+		fmt.Fprintln(w, "ID\tAGENT\tLISTEN\tDIAL\tEXPIRES")
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", t.ID, t.AgentUUID, t.Listen, t.Dial, formatExpires(t.ExpiresAt))
+	})
+}
+
+func runTunnelsClose() {
+	call("DELETE", "/v1/tunnels/"+url.PathEscape(*tunnelsCloseF), nil, nil)
+}
+
+func runTunnelsDrift() {
+	var drift []admin.Drift
+	call("GET", "/v1/declarations/drift", nil, &drift)
+	output(drift, func(w io.Writer) {
+		fmt.Fprintln(w, "AGENT\tDIAL\tSTATE\tTUNNEL\tERROR")
+		for _, d := range drift {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", d.AgentUUID, d.Dial, d.State, formatEmpty(d.TunnelID), formatEmpty(d.Error))
+		}
+	})
+}
+
+func runPortsList() {
+	var allocations []admin.PortAllocation
+	call("GET", "/v1/ports", nil, &allocations)
+	output(allocations, func(w io.Writer) {
+		fmt.Fprintln(w, "PORT\tAGENT\tDIAL")
+		for _, al := range allocations {
+			fmt.Fprintf(w, "%d\t%s\t%s\n", al.Port, al.AgentUUID, al.Dial)
+		}
+	})
+}
+
+func runPortsRelease() {
+	call("DELETE", fmt.Sprintf("/v1/ports/%d", *portsReleaseF), nil, nil)
+}
+
+func runTokensCreate() {
+	var res admin.CreateTokenResponse
+	call("POST", "/v1/enrollment-tokens", &admin.CreateTokenRequest{
+		TTL: tokensCreateF.String(),
+	}, &res)
+	output(res, func(w io.Writer) {
+		fmt.Fprintf(w, "%s\t(expires at %s)\n", res.Token, res.ExpiresAt.Local().Format(time.RFC3339))
+	})
+}
+
+func formatExpires(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+func formatEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func formatLatency(ms float64) string {
+	if ms == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.1fms", ms)
+}
@@ -17,57 +17,46 @@
 package main
 
 import (
-	"net/http"
-	"os"
-	"os/signal"
-	"syscall"
-
-	"github.com/Percona-Lab/wsrpc"
-	"github.com/sirupsen/logrus"
 	"gopkg.in/alecthomas/kingpin.v2"
-
-	"github.com/Percona-Lab/pmm-api/agent"
-	"github.com/Percona-Lab/pmm-api/gateway"
-	"github.com/Percona-Lab/pmm-gateway/tunnel"
 )
 
-func handler(rw http.ResponseWriter, req *http.Request) {
-	conn, err := wsrpc.Upgrade(rw, req, nil)
-	if err != nil {
-		logrus.Error(err)
-		http.Error(rw, err.Error(), 400)
-		return
-	}
-	logrus.Infof("Connection from %s.", req.RemoteAddr)
-	defer conn.Close()
-
-	server := tunnel.NewService(agent.NewServiceClient(conn))
+const defaultAdminAddress = "127.0.0.1:7782"
 
-	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGINFO)
-	go func() {
-		const dial = "127.0.0.1:9100"
-		<-signals
-		logrus.Infof("Creating tunnel to %s", dial)
-		res, err := server.CreateTunnel(&gateway.CreateTunnelRequest{
-			Dial: dial,
-		})
-		if err != nil {
-			logrus.Fatal(err)
-		}
-		logrus.Info(res)
-	}()
-
-	err = gateway.NewServiceDispatcher(conn, server).Run()
-	logrus.Infof("Server exited with %v", err)
-}
+// adminTokenFileF is used both by serve command and by admin API client commands.
+var adminTokenFileF = kingpin.Flag("admin-token-file", "File with admin API bearer token: serve requires it in requests, "+
+	"and also requires this flag if admin API listens on non-loopback address; other commands send it").String()
 
 func main() {
-	logrus.SetLevel(logrus.DebugLevel)
-	kingpin.Parse()
-
-	http.Handle("/", http.HandlerFunc(handler))
-	const addr = "127.0.0.1:7781"
-	logrus.Infof("Listening on %s...", addr)
-	logrus.Fatal(http.ListenAndServe(addr, nil))
+	kingpin.HelpFlag.Short('h')
+
+	switch kingpin.Parse() {
+	case serveCmd.FullCommand():
+		runServe()
+	case agentsListCmd.FullCommand():
+		runAgentsList()
+	case agentsPingCmd.FullCommand():
+		runAgentsPing()
+	case agentsKickCmd.FullCommand():
+		runAgentsKick()
+	case agentsRevokeCmd.FullCommand():
+		runAgentsRevoke()
+	case agentsKnownCmd.FullCommand():
+		runAgentsKnown()
+	case agentsForgetCmd.FullCommand():
+		runAgentsForget()
+	case tunnelsListCmd.FullCommand():
+		runTunnelsList()
+	case tunnelsCreateCmd.FullCommand():
+		runTunnelsCreate()
+	case tunnelsCloseCmd.FullCommand():
+		runTunnelsClose()
+	case tunnelsDriftCmd.FullCommand():
+		runTunnelsDrift()
+	case portsListCmd.FullCommand():
+		runPortsList()
+	case portsReleaseCmd.FullCommand():
+		runPortsRelease()
+	case tokensCreateCmd.FullCommand():
+		runTokensCreate()
+	}
 }
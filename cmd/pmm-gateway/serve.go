@@ -0,0 +1,494 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Percona-Lab/wsrpc"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/Percona-Lab/pmm-gateway/admin"
+	"github.com/Percona-Lab/pmm-gateway/auth"
+	"github.com/Percona-Lab/pmm-gateway/ca"
+	"github.com/Percona-Lab/pmm-gateway/ports"
+	"github.com/Percona-Lab/pmm-gateway/static"
+	"github.com/Percona-Lab/pmm-gateway/store"
+	"github.com/Percona-Lab/pmm-gateway/tunnel"
+)
+
+var (
+	serveCmd = kingpin.Command("serve", "Run gateway server").Default()
+
+	authTokensFileF = serveCmd.Flag("auth-tokens-file", "File with agent UUIDs and bearer tokens").String()
+	authSecretFileF = serveCmd.Flag("auth-hmac-secret-file", "File with shared secret for HMAC-signed requests").String()
+
+	listenAddressF        = serveCmd.Flag("listen-address", "Plain HTTP listen address for agents").Default("127.0.0.1:7781").String()
+	tlsListenAddressF     = serveCmd.Flag("tls-listen-address", "TLS listen address for agents (disabled if empty)").String()
+	tlsCertFileF          = serveCmd.Flag("tls-cert-file", "Server TLS certificate file").String()
+	tlsKeyFileF           = serveCmd.Flag("tls-key-file", "Server TLS key file").String()
+	tlsClientCAFileF      = serveCmd.Flag("tls-client-ca-file", "CA certificates file for client certificates verification").String()
+	tlsRequireClientCertF = serveCmd.Flag("tls-require-client-cert", "Reject TLS connections without valid client certificate").Bool()
+
+	adminListenAddressF      = serveCmd.Flag("admin-listen-address", "Admin API and /metrics listen address (disabled if empty); non-loopback address requires --admin-token-file").Default(defaultAdminAddress).String()
+	prometheusListenAddressF = serveCmd.Flag("prometheus-listen-address", "Prometheus service discovery, scrape proxy and /metrics listen address (disabled if empty)").Default("127.0.0.1:7783").String()
+
+	dispatcherWorkersF    = serveCmd.Flag("dispatcher-workers", "Number of concurrent request handlers per agent session").Default(strconv.Itoa(tunnel.DefaultWorkers)).Int()
+	agentRPCTimeoutsF     = serveCmd.Flag("agent-rpc-timeout", "Timeout of agent's RPC method, like CreateTunnel=10s (repeatable)").PlaceHolder("METHOD=DURATION").StringMap()
+	tunnelCoalesceDelayF  = serveCmd.Flag("tunnel-coalesce-delay", "Time to wait for more data to send it to agent in a single chunk (0 to disable)").Default(tunnel.DefaultCoalesceDelay.String()).Duration()
+	tunnelWindowF         = serveCmd.Flag("tunnel-window", "Maximal amount of data in flight per tunnel connection in each direction").Default(strconv.Itoa(tunnel.DefaultWindow/1024) + "KiB").Bytes()
+	tunnelPortRangeF      = serveCmd.Flag("tunnel-port-range", "Range of stable tunnel listen ports, like 20000-20999 (random ports if empty)").String()
+	tunnelPortsFileF      = serveCmd.Flag("tunnel-ports-file", "File with tunnel port allocations (state file is used if empty)").String()
+	tunnelGracePeriodF    = serveCmd.Flag("tunnel-grace-period", "Time to keep disconnected agent's tunnels listening for its reconnect (0 to close them immediately)").Default("1m").Duration()
+	tunnelQueueTimeoutF   = serveCmd.Flag("tunnel-queue-timeout", "Time new tunnel connections wait for disconnected agent to reconnect (0 to refuse them)").Default("10s").Duration()
+	sessionResumeTimeoutF = serveCmd.Flag("session-resume-timeout", "Time to wait for agent to resume its session after connection broke (0 to disable resumption)").Default("30s").Duration()
+	agentPingIntervalF    = serveCmd.Flag("agent-ping-interval", "Interval of WebSocket pings sent to agents").Default("30s").Duration()
+	agentMaxMissedPongsF  = serveCmd.Flag("agent-max-missed-pongs", "Number of missed pongs after which agent's session is evicted and its tunnels are closed (0 to disable)").Default("3").Int()
+	tunnelsFileF          = serveCmd.Flag("tunnels-file", "JSON file with static tunnel declarations (disabled if empty)").String()
+
+	fileSDF = serveCmd.Flag("prometheus-file-sd", "Write tunnels as Prometheus file service discovery targets to that JSON file (disabled if empty)").String()
+
+	stateFileF = serveCmd.Flag("state-file", "Database file with known agents, persistent tunnels, port allocations and CA state (not persisted if empty)").String()
+
+	caDirF     = serveCmd.Flag("ca-dir", "Directory with built-in CA key, certificate and state (disabled if empty)").String()
+	caCertTTLF = serveCmd.Flag("ca-cert-ttl", "Validity period of issued agent certificates").Default("24h").Duration()
+)
+
+var (
+	registry      = tunnel.NewRegistry()
+	authenticator *auth.Authenticator
+	rpcTimeouts   = make(map[string]time.Duration)
+	allocator     *ports.Allocator
+	declarations  *static.Manager
+	stateStore    *store.Store
+
+	agentConnectsV = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pmm_gateway",
+		Name:      "agent_connects_total",
+		Help:      "Number of agents' connection attempts by result.",
+	}, []string{"result"})
+	agentDisconnectsV = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "pmm_gateway",
+		Name:      "agent_disconnects_total",
+		Help:      "Number of ended agents' sessions by reason.",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(registry, agentConnectsV, agentDisconnectsV)
+}
+
+func handler(rw http.ResponseWriter, req *http.Request) {
+	identity, err := authenticator.Authenticate(req)
+	if err != nil {
+		code := 401
+		if e, ok := err.(*auth.Error); ok {
+			code = e.Code
+		}
+		logrus.Warnf("Failed to authenticate %s: %s.", req.RemoteAddr, err)
+		http.Error(rw, err.Error(), code)
+		agentConnectsV.WithLabelValues("auth_failed").Inc()
+		return
+	}
+
+	uuid := identity.AgentUUID
+	sessionID := req.Header.Get(tunnel.SessionHeader)
+	if existing := registry.Get(uuid); existing != nil {
+		if sessionID != "" && sessionID == existing.SessionID() {
+			resume(rw, req, existing)
+			return
+		}
+
+		// agent lost its session state; do not wait for resume, so it can reconnect
+		existing.Abandon()
+		msg := fmt.Sprintf("Agent %q is already connected.", uuid)
+		logrus.Error(msg)
+		http.Error(rw, msg, 409)
+		agentConnectsV.WithLabelValues("already_connected").Inc()
+		return
+	}
+
+	respHeaders := make(http.Header)
+	legacy := req.Header.Get(tunnel.ProtocolHeader) != tunnel.ProtocolFrames
+	if !legacy {
+		respHeaders.Set(tunnel.ProtocolHeader, tunnel.ProtocolFrames)
+	}
+	if sessionID != "" && uuid != "" && !legacy && *sessionResumeTimeoutF > 0 {
+		// new session is also started if agent tries to resume unknown or ended one
+		sessionID = tunnel.NewSessionID()
+		respHeaders.Set(tunnel.SessionHeader, sessionID)
+	} else {
+		sessionID = ""
+	}
+	conn, err := wsrpc.Upgrade(rw, req, respHeaders)
+	if err != nil {
+		logrus.Error(err)
+		http.Error(rw, err.Error(), 400)
+		agentConnectsV.WithLabelValues("upgrade_failed").Inc()
+		return
+	}
+	logrus.Infof("Connection from %s (agent %q, authenticated by %s).", req.RemoteAddr, uuid, identity.Method)
+	if legacy {
+		logrus.Warnf("Agent %q uses legacy tunnel protocol without flow control and session resumption.", uuid)
+	}
+	defer conn.Close()
+
+	server := tunnel.NewService(identity, req.RemoteAddr, conn, registry, tunnel.Config{
+		Hostname:       req.Header.Get(auth.HostnameHeader),
+		Labels:         parseLabels(req.Header.Get(auth.LabelsHeader)),
+		CoalesceDelay:  *tunnelCoalesceDelayF,
+		RPCTimeouts:    rpcTimeouts,
+		Ports:          allocator,
+		SessionID:      sessionID,
+		Legacy:         legacy,
+		Window:         int(*tunnelWindowF),
+		PingInterval:   *agentPingIntervalF,
+		MaxMissedPongs: *agentMaxMissedPongsF,
+	})
+	if uuid != "" {
+		if err = registry.Add(server); err != nil {
+			logrus.Error(err)
+			agentConnectsV.WithLabelValues("already_connected").Inc()
+			return
+		}
+		defer registry.Remove(server)
+	}
+	defer server.Close()
+	agentConnectsV.WithLabelValues("ok").Inc()
+
+	if stateStore != nil && uuid != "" {
+		saveAgent(server)
+		defer saveAgent(server)
+	}
+	if uuid != "" {
+		server.RestoreTunnels()
+	}
+	if declarations != nil && uuid != "" {
+		go declarations.Apply(server)
+	}
+
+	for {
+		d := tunnel.NewDispatcher(conn, server, *dispatcherWorkersF)
+		err = d.Run()
+		conn.Close()
+		logrus.Infof("Server exited with %v", err)
+
+		reason := d.ExitReason()
+		switch {
+		case server.Kicked():
+			reason = "kicked"
+		case server.Evicted():
+			reason = "evicted"
+			logrus.Warnf("Agent %q missed %d pongs, evicting session.", uuid, server.MissedPongs())
+		}
+		agentDisconnectsV.WithLabelValues(reason).Inc()
+
+		// continue with agent's new connection if session is resumed
+		if conn = server.Suspend(*sessionResumeTimeoutF); conn == nil {
+			return
+		}
+	}
+}
+
+// resume resumes agent's suspended session on a new connection, which is then served by the session's handler.
+func resume(rw http.ResponseWriter, req *http.Request, server *tunnel.Service) {
+	var upgraded bool
+	err := server.Resume(req.Header.Get(tunnel.StreamsHeader), func(h http.Header) (*wsrpc.Conn, error) {
+		upgraded = true
+		h.Set(tunnel.SessionHeader, server.SessionID())
+		return wsrpc.Upgrade(rw, req, h)
+	})
+	if err != nil {
+		logrus.Warnf("Failed to resume session from %s: %s.", req.RemoteAddr, err)
+		if !upgraded {
+			// agent should retry
+			http.Error(rw, err.Error(), 409)
+		}
+		agentConnectsV.WithLabelValues("resume_failed").Inc()
+		return
+	}
+	logrus.Infof("Connection from %s resumed agent %q session %s.", req.RemoteAddr, server.UUID(), server.SessionID())
+	agentConnectsV.WithLabelValues("resumed").Inc()
+}
+
+// saveAgent updates known agent record in state store.
+func saveAgent(s *tunnel.Service) {
+	now := time.Now()
+	err := stateStore.SaveAgent(&store.Agent{
+		UUID:        s.UUID(),
+		Hostname:    s.Hostname(),
+		Labels:      s.Labels(),
+		RemoteAddr:  s.RemoteAddr(),
+		FirstSeenAt: now,
+		LastSeenAt:  now,
+		Evicted:     s.Evicted(),
+	})
+	if err != nil {
+		logrus.Errorf("Failed to save agent %q: %s.", s.UUID(), err)
+	}
+}
+
+// parseLabels parses agent's labels like "env=prod,dc=eu1". Malformed labels are ignored.
+func parseLabels(s string) map[string]string {
+	if s == "" {
+		return nil
+	}
+	res := make(map[string]string)
+	for _, l := range strings.Split(s, ",") {
+		parts := strings.SplitN(l, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			continue
+		}
+		res[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return res
+}
+
+// declarationsInterval is the interval of recreating missing declared tunnels.
+const declarationsInterval = 30 * time.Second
+
+// runDeclarations periodically recreates missing declared tunnels of connected agents.
+func runDeclarations() {
+	for {
+		time.Sleep(declarationsInterval)
+		for _, s := range registry.Services() {
+			declarations.Apply(s)
+		}
+	}
+}
+
+// maxTunnelWindow is the maximal value of --tunnel-window; replay buffers of resumable sessions are several times larger.
+const maxTunnelWindow = 64 << 20
+
+// fileSDInterval is the interval of file service discovery targets update.
+const fileSDInterval = 5 * time.Second
+
+// runFileSD periodically writes tunnels as Prometheus file service discovery targets.
+// File is replaced atomically and only when targets are changed.
+func runFileSD(path string) {
+	var last []byte
+	for {
+		b, err := json.MarshalIndent(admin.TargetGroups(registry, ""), "", "  ")
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if !bytes.Equal(b, last) {
+			tmp := path + ".tmp"
+			if err = ioutil.WriteFile(tmp, b, 0644); err == nil {
+				err = os.Rename(tmp, path)
+			}
+			if err != nil {
+				logrus.Errorf("Failed to write Prometheus targets: %s.", err)
+			} else {
+				last = b
+			}
+		}
+		time.Sleep(fileSDInterval)
+	}
+}
+
+// isLoopback returns true if listen address host is loopback IP address or localhost.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func runServe() {
+	logrus.SetLevel(logrus.DebugLevel)
+
+	for method, s := range *agentRPCTimeoutsF {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			logrus.Fatalf("Invalid timeout %q for agent's RPC method %s.", s, method)
+		}
+		rpcTimeouts[method] = d
+	}
+
+	if *tunnelWindowF <= 0 || *tunnelWindowF > maxTunnelWindow {
+		logrus.Fatalf("Invalid tunnel window %s, should be positive and up to %dMiB.", *tunnelWindowF, maxTunnelWindow>>20)
+	}
+	if *agentPingIntervalF <= 0 {
+		logrus.Fatalf("Invalid agent ping interval %s.", *agentPingIntervalF)
+	}
+	if *agentMaxMissedPongsF < 0 {
+		logrus.Fatalf("Invalid number of agent's missed pongs %d.", *agentMaxMissedPongsF)
+	}
+
+	var adminToken string
+	if *adminTokenFileF != "" {
+		var err error
+		if adminToken, err = auth.LoadToken(*adminTokenFileF); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	if *adminListenAddressF != "" && adminToken == "" && !isLoopback(*adminListenAddressF) {
+		logrus.Fatalf("Admin API listen address %s is not loopback, --admin-token-file is required.", *adminListenAddressF)
+	}
+
+	registry.SetGracePeriod(*tunnelGracePeriodF, *tunnelQueueTimeoutF)
+
+	if *stateFileF != "" {
+		var err error
+		if stateStore, err = store.Open(*stateFileF); err != nil {
+			logrus.Fatal(err)
+		}
+		registry.SetDefinitionStore(stateStore)
+	} else {
+		logrus.Warn("Gateway state is not persisted.")
+	}
+
+	if *tunnelPortRangeF != "" {
+		min, max, err := ports.ParseRange(*tunnelPortRangeF)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		var storage ports.Storage
+		switch {
+		case *tunnelPortsFileF != "":
+			storage = ports.FileStorage(*tunnelPortsFileF)
+		case stateStore != nil:
+			storage = stateStore
+		}
+		if allocator, err = ports.New(min, max, storage); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	var tokens map[string]string
+	if *authTokensFileF != "" {
+		var err error
+		if tokens, err = auth.LoadTokens(*authTokensFileF); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+	var secret []byte
+	if *authSecretFileF != "" {
+		b, err := ioutil.ReadFile(*authSecretFileF)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		secret = bytes.TrimSpace(b)
+	}
+	authenticator = auth.NewAuthenticator(tokens, secret)
+	if !authenticator.Enabled() {
+		logrus.Warn("Agent authentication is disabled.")
+	}
+
+	var clientCAs *x509.CertPool
+	if *tlsClientCAFileF != "" {
+		var err error
+		if clientCAs, err = auth.LoadCertPool(*tlsClientCAFileF); err != nil {
+			logrus.Fatal(err)
+		}
+	}
+
+	var authority *ca.CA
+	if *caDirF != "" {
+		var err error
+		var storage ca.Storage
+		if stateStore != nil {
+			storage = stateStore
+		}
+		if authority, err = ca.New(*caDirF, *caCertTTLF, storage); err != nil {
+			logrus.Fatal(err)
+		}
+
+		if clientCAs == nil {
+			clientCAs = x509.NewCertPool()
+		}
+		clientCAs.AddCert(authority.Certificate())
+		authenticator.SetRevocationList(authority)
+		http.Handle("/enroll", authority.EnrollHandler())
+		http.Handle("/renew", authority.RenewHandler())
+	}
+
+	http.Handle("/", http.HandlerFunc(handler))
+
+	if *tunnelsFileF != "" {
+		var err error
+		if declarations, err = static.Load(*tunnelsFileF); err != nil {
+			logrus.Fatal(err)
+		}
+		go runDeclarations()
+	}
+
+	if *fileSDF != "" {
+		go runFileSD(*fileSDF)
+	}
+
+	if *adminListenAddressF != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.Handle("/", admin.NewServer(registry, authority, allocator, declarations, stateStore))
+		var h http.Handler = mux
+		if adminToken != "" {
+			h = auth.RequireToken(adminToken, mux)
+		}
+		go func() {
+			logrus.Infof("Admin API listening on %s...", *adminListenAddressF)
+			logrus.Fatal(http.ListenAndServe(*adminListenAddressF, h))
+		}()
+	}
+
+	if *prometheusListenAddressF != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		mux.Handle("/", admin.NewPrometheusServer(registry, declarations))
+		go func() {
+			logrus.Infof("Prometheus endpoints listening on %s...", *prometheusListenAddressF)
+			logrus.Fatal(http.ListenAndServe(*prometheusListenAddressF, mux))
+		}()
+	}
+
+	if *tlsListenAddressF != "" {
+		config, err := auth.ServerTLSConfig(*tlsCertFileF, *tlsKeyFileF, clientCAs, *tlsRequireClientCertF)
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		server := &http.Server{
+			Addr:      *tlsListenAddressF,
+			TLSConfig: config,
+		}
+		go func() {
+			logrus.Infof("Listening on %s (TLS)...", server.Addr)
+			logrus.Fatal(server.ListenAndServeTLS("", ""))
+		}()
+	}
+
+	logrus.Infof("Listening on %s...", *listenAddressF)
+	logrus.Fatal(http.ListenAndServe(*listenAddressF, nil))
+}
@@ -0,0 +1,293 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package ports allocates stable tunnel listen ports.
+//
+// Each (agent UUID, dial address) pair gets a port from configured range on first use, and the same port
+// after that, across agent reconnects and (if allocation table is persisted) gateway restarts.
+package ports
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// listenHost is the host tunnels listen on.
+const listenHost = "127.0.0.1"
+
+// Allocation represents allocated port.
+type Allocation struct {
+	Port      int    `json:"port"`
+	AgentUUID string `json:"agent_uuid"`
+	Dial      string `json:"dial"`
+}
+
+type key struct {
+	agentUUID string
+	dial      string
+}
+
+// Storage persists allocation table.
+type Storage interface {
+	// LoadAllocations returns saved allocations.
+	LoadAllocations() ([]Allocation, error)
+
+	// SaveAllocations replaces saved allocations with given ones.
+	SaveAllocations(allocations []Allocation) error
+}
+
+// FileStorage stores allocation table in a JSON file with given path.
+type FileStorage string
+
+// file is JSON allocation table file.
+type file struct {
+	Allocations []Allocation `json:"allocations"`
+}
+
+// LoadAllocations implements Storage.
+func (path FileStorage) LoadAllocations() ([]Allocation, error) {
+	b, err := ioutil.ReadFile(string(path))
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, errors.WithStack(err)
+	}
+	var f file
+	if err = json.Unmarshal(b, &f); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", path)
+	}
+	return f.Allocations, nil
+}
+
+// SaveAllocations implements Storage.
+func (path FileStorage) SaveAllocations(allocations []Allocation) error {
+	b, err := json.MarshalIndent(file{Allocations: allocations}, "", "  ")
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if err = ioutil.WriteFile(string(path)+".tmp", b, 0600); err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(os.Rename(string(path)+".tmp", string(path)))
+}
+
+// Allocator allocates ports from range. All methods are safe for concurrent use.
+type Allocator struct {
+	min, max int
+	storage  Storage // nil if allocation table is not persisted
+
+	m         sync.Mutex
+	byKey     map[key]*Allocation
+	byPort    map[int]*Allocation
+	listening map[int]bool // ports with listeners returned by Listen and not closed yet
+}
+
+// listener marks port as not listening on close.
+type listener struct {
+	net.Listener
+	a    *Allocator
+	port int
+	once sync.Once
+}
+
+// Close implements net.Listener.
+func (l *listener) Close() error {
+	err := l.Listener.Close()
+	l.once.Do(func() {
+		l.a.m.Lock()
+		delete(l.a.listening, l.port)
+		l.a.m.Unlock()
+	})
+	return err
+}
+
+// ParseRange parses port range like "20000-20999".
+func ParseRange(s string) (min, max int, err error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) == 2 {
+		min, err = strconv.Atoi(parts[0])
+		if err == nil {
+			max, err = strconv.Atoi(parts[1])
+		}
+	}
+	if len(parts) != 2 || err != nil || min <= 0 || max > 65535 || min > max {
+		return 0, 0, errors.Errorf("invalid port range %q, should be like 20000-20999", s)
+	}
+	return min, max, nil
+}
+
+// New creates a new allocator for ports from min to max inclusive. If storage is not nil,
+// allocation table is loaded from it and saved to it on changes.
+// Allocations outside of range are dropped.
+func New(min, max int, storage Storage) (*Allocator, error) {
+	a := &Allocator{
+		min:       min,
+		max:       max,
+		storage:   storage,
+		byKey:     make(map[key]*Allocation),
+		byPort:    make(map[int]*Allocation),
+		listening: make(map[int]bool),
+	}
+	if storage == nil {
+		return a, nil
+	}
+
+	allocations, err := storage.LoadAllocations()
+	if err != nil {
+		return nil, err
+	}
+	for i := range allocations {
+		al := &allocations[i]
+		if al.Port < min || al.Port > max {
+			logrus.Warnf("Dropping port %d allocation for %s via agent %q: port is out of range %d-%d.",
+				al.Port, al.Dial, al.AgentUUID, min, max)
+			continue
+		}
+		a.add(al)
+	}
+	return a, nil
+}
+
+// Range returns port range.
+func (a *Allocator) Range() (min, max int) {
+	return a.min, a.max
+}
+
+func (a *Allocator) add(al *Allocation) {
+	a.byKey[key{al.AgentUUID, al.Dial}] = al
+	a.byPort[al.Port] = al
+}
+
+// Listen listens on port allocated for given agent and dial address, allocating a new port if needed.
+// A new port is the lowest port in range which is not allocated and not used by other processes.
+// Only one listener for given agent and dial address may be open at a time.
+func (a *Allocator) Listen(agentUUID, dial string) (net.Listener, error) {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	if al := a.byKey[key{agentUUID, dial}]; al != nil {
+		if a.listening[al.Port] {
+			return nil, errors.Errorf("tunnel to %s via agent %q already exists on port %d", dial, agentUUID, al.Port)
+		}
+		l, err := net.Listen("tcp", net.JoinHostPort(listenHost, strconv.Itoa(al.Port)))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to listen on port %d allocated for %s via agent %q", al.Port, dial, agentUUID)
+		}
+		return a.listener(l, al.Port), nil
+	}
+
+	var busy int
+	for port := a.min; port <= a.max; port++ {
+		if a.byPort[port] != nil {
+			continue
+		}
+		l, err := net.Listen("tcp", net.JoinHostPort(listenHost, strconv.Itoa(port)))
+		if err != nil {
+			busy++
+			continue
+		}
+
+		a.add(&Allocation{
+			Port:      port,
+			AgentUUID: agentUUID,
+			Dial:      dial,
+		})
+		if err = a.save(); err != nil {
+			logrus.Errorf("Failed to save port allocations: %s.", err)
+		}
+		return a.listener(l, port), nil
+	}
+
+	return nil, errors.Errorf("port range %d-%d is exhausted: %d ports are allocated to other tunnels, %d are in use by other processes",
+		a.min, a.max, len(a.byPort), busy)
+}
+
+// listener marks port as listening and wraps l. Caller should hold lock.
+func (a *Allocator) listener(l net.Listener, port int) net.Listener {
+	a.listening[port] = true
+	return &listener{Listener: l, a: a, port: port}
+}
+
+// Allocations returns all allocations sorted by port.
+func (a *Allocator) Allocations() []Allocation {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	return a.allocations()
+}
+
+// allocations returns all allocations sorted by port. Caller should hold lock.
+func (a *Allocator) allocations() []Allocation {
+	res := make([]Allocation, 0, len(a.byPort))
+	for _, al := range a.byPort {
+		res = append(res, *al)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Port < res[j].Port })
+	return res
+}
+
+// Release removes port allocation, so port may be allocated for other tunnel.
+// It does not close tunnel's listener if it is open.
+func (a *Allocator) Release(port int) error {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	al := a.byPort[port]
+	if al == nil {
+		return errors.Errorf("port %d is not allocated", port)
+	}
+	delete(a.byPort, port)
+	delete(a.byKey, key{al.AgentUUID, al.Dial})
+	return a.save()
+}
+
+// ReleaseAgent removes all port allocations of given agent, for example, when it is forgotten.
+// It does not close tunnels' listeners if they are open.
+func (a *Allocator) ReleaseAgent(agentUUID string) error {
+	a.m.Lock()
+	defer a.m.Unlock()
+
+	var released bool
+	for k, al := range a.byKey {
+		if k.agentUUID == agentUUID {
+			delete(a.byPort, al.Port)
+			delete(a.byKey, k)
+			released = true
+		}
+	}
+	if !released {
+		return nil
+	}
+	return a.save()
+}
+
+// save writes allocation table to storage, if it is persisted. Caller should hold lock.
+func (a *Allocator) save() error {
+	if a.storage == nil {
+		return nil
+	}
+	return a.storage.SaveAllocations(a.allocations())
+}
@@ -0,0 +1,246 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package ports
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+// freeRange returns a range of n ports which are not used at the moment.
+func freeRange(t *testing.T, n int) (min, max int) {
+	t.Helper()
+
+	for i := 0; i < 10; i++ {
+		l, err := net.Listen("tcp", listenHost+":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		min = l.Addr().(*net.TCPAddr).Port
+		l.Close()
+		if min+n-1 > 65535 {
+			continue
+		}
+
+		free := true
+		for port := min; port < min+n && free; port++ {
+			l, err = net.Listen("tcp", net.JoinHostPort(listenHost, strconv.Itoa(port)))
+			if err != nil {
+				free = false
+				continue
+			}
+			l.Close()
+		}
+		if free {
+			return min, min + n - 1
+		}
+	}
+	t.Fatalf("failed to find %d free ports", n)
+	return 0, 0
+}
+
+func TestParseRange(t *testing.T) {
+	for _, tc := range []struct {
+		s        string
+		min, max int
+		err      bool
+	}{
+		{"20000-20999", 20000, 20999, false},
+		{"20000-20000", 20000, 20000, false},
+		{"20000", 0, 0, true},
+		{"20999-20000", 0, 0, true},
+		{"0-10", 0, 0, true},
+		{"20000-65536", 0, 0, true},
+		{"a-b", 0, 0, true},
+	} {
+		min, max, err := ParseRange(tc.s)
+		if (err != nil) != tc.err || min != tc.min || max != tc.max {
+			t.Errorf("%q: expected %d, %d, error %v; got %d, %d, %v", tc.s, tc.min, tc.max, tc.err, min, max, err)
+		}
+	}
+}
+
+func TestAllocator(t *testing.T) {
+	min, max := freeRange(t, 3)
+	a, err := New(min, max, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listeners := make(map[key]net.Listener)
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	// each step listens for given agent and dial address unless close or release is set
+	for i, step := range []struct {
+		agentUUID string
+		dial      string
+		close     bool // close listener for agent and dial address
+		release   int  // release port with this offset from min
+		port      int  // expected port offset from min, or -1 for error
+	}{
+		{"agent1", "127.0.0.1:9100", false, -1, 0},
+		{"agent1", "127.0.0.1:9104", false, -1, 1},
+		{"agent2", "127.0.0.1:9100", false, -1, 2},
+		{"agent1", "127.0.0.1:9100", false, -1, -1}, // already listening
+		{"agent3", "127.0.0.1:9100", false, -1, -1}, // range is exhausted
+
+		// the same port after listener is closed
+		{"agent1", "127.0.0.1:9100", true, -1, 0},
+		{"agent1", "127.0.0.1:9100", false, -1, 0},
+
+		// released port is reused for other tunnel even if listener is still open
+		{"agent2", "127.0.0.1:9100", true, -1, 0},
+		{"", "", false, 2, 0},
+		{"agent3", "127.0.0.1:9100", false, -1, 2},
+	} {
+		k := key{step.agentUUID, step.dial}
+		switch {
+		case step.close:
+			listeners[k].Close()
+			delete(listeners, k)
+			continue
+		case step.release >= 0:
+			if err = a.Release(min + step.release); err != nil {
+				t.Fatalf("step %d: %s", i, err)
+			}
+			continue
+		}
+
+		l, err := a.Listen(step.agentUUID, step.dial)
+		if step.port < 0 {
+			if err == nil {
+				l.Close()
+				t.Fatalf("step %d: expected error, got listener on %s", i, l.Addr())
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("step %d: %s", i, err)
+		}
+		listeners[k] = l
+		if port := l.Addr().(*net.TCPAddr).Port; port != min+step.port {
+			t.Fatalf("step %d: expected port %d, got %d", i, min+step.port, port)
+		}
+	}
+
+	if err = a.Release(min + 2); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Release(min + 2); err == nil {
+		t.Error("expected error for port which is not allocated")
+	}
+	if err = a.ReleaseAgent("agent1"); err != nil {
+		t.Fatal(err)
+	}
+	if al := a.Allocations(); len(al) != 0 {
+		t.Errorf("unexpected allocations %v", al)
+	}
+}
+
+func TestAllocatorBusyPort(t *testing.T) {
+	min, max := freeRange(t, 2)
+	busy, err := net.Listen("tcp", net.JoinHostPort(listenHost, strconv.Itoa(min)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+
+	a, err := New(min, max, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := a.Listen("agent1", "127.0.0.1:9100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if port := l.Addr().(*net.TCPAddr).Port; port != max {
+		t.Errorf("expected port %d, got %d", max, port)
+	}
+
+	expected := "port range " + strconv.Itoa(min) + "-" + strconv.Itoa(max) +
+		" is exhausted: 1 ports are allocated to other tunnels, 1 are in use by other processes"
+	if _, err = a.Listen("agent1", "127.0.0.1:9104"); err == nil || err.Error() != expected {
+		t.Errorf("expected error %q, got %v", expected, err)
+	}
+}
+
+func TestFileStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pmm-gateway-ports-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage := FileStorage(filepath.Join(dir, "ports.json"))
+
+	min, max := freeRange(t, 2)
+	a, err := New(min, max, storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []key{{"agent1", "127.0.0.1:9100"}, {"agent2", "127.0.0.1:9100"}} {
+		l, err := a.Listen(k.agentUUID, k.dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+	}
+	expected := []Allocation{
+		{Port: min, AgentUUID: "agent1", Dial: "127.0.0.1:9100"},
+		{Port: max, AgentUUID: "agent2", Dial: "127.0.0.1:9100"},
+	}
+
+	for _, tc := range []struct {
+		name     string
+		min, max int
+		expected []Allocation
+	}{
+		{"SameRange", min, max, expected},
+		{"NarrowedRange", min, min, expected[:1]}, // allocations out of range are dropped
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			a, err := New(tc.min, tc.max, storage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if actual := a.Allocations(); !reflect.DeepEqual(tc.expected, actual) {
+				t.Errorf("expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+
+	// allocations are saved on release
+	if err = a.ReleaseAgent("agent1"); err != nil {
+		t.Fatal(err)
+	}
+	actual, err := storage.LoadAllocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expected[1:], actual) {
+		t.Errorf("expected %v, got %v", expected[1:], actual)
+	}
+}
@@ -0,0 +1,231 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package static manages tunnels declared in configuration file.
+//
+// File is JSON like:
+//
+//	{
+//	  "tunnels": [
+//	    {"agent_uuid": "uuid1", "dial": "127.0.0.1:9100", "service_type": "node_exporter"},
+//	    {"agent_selector": {"env": "prod"}, "dial": "127.0.0.1:9104", "service_type": "mysqld_exporter"}
+//	  ]
+//	}
+//
+// Declaration applies to agent with given UUID, or to all agents with labels matching selector.
+// Declared tunnels are created when agent's session starts, and recreated if they are missing.
+package static
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-gateway/tunnel"
+)
+
+// Declaration declares tunnel.
+type Declaration struct {
+	AgentUUID     string            `json:"agent_uuid,omitempty"`
+	AgentSelector map[string]string `json:"agent_selector,omitempty"` // all labels should match
+	Dial          string            `json:"dial"`
+	ServiceType   string            `json:"service_type,omitempty"`
+	Weight        int               `json:"weight,omitempty"`
+}
+
+// Matches returns true if declaration applies to agent with given UUID and labels.
+func (d *Declaration) Matches(uuid string, labels map[string]string) bool {
+	if d.AgentUUID != "" {
+		return d.AgentUUID == uuid
+	}
+	for k, v := range d.AgentSelector {
+		if lv, ok := labels[k]; !ok || lv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Drift states.
+const (
+	DriftMissing           = "missing"            // declared tunnel does not exist
+	DriftUndeclared        = "undeclared"         // tunnel exists, but is not declared
+	DriftAgentDisconnected = "agent_disconnected" // agent with declared tunnels is not connected
+)
+
+// Drift represents difference between declared and actual tunnels.
+type Drift struct {
+	AgentUUID string
+	Dial      string
+	State     string
+	TunnelID  string // for undeclared tunnel
+	Error     string // the last error of declared tunnel creation
+}
+
+type key struct {
+	agentUUID string
+	dial      string
+}
+
+// Manager creates declared tunnels and reports drift. All methods are safe for concurrent use.
+type Manager struct {
+	decls  []Declaration
+	applyM sync.Mutex // serializes Apply calls, so tunnels are not created twice
+
+	m      sync.Mutex
+	errors map[key]string // the last tunnel creation errors
+}
+
+// Load loads declarations from file.
+func Load(path string) (*Manager, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+	var file struct {
+		Tunnels []Declaration `json:"tunnels"`
+	}
+	if err = json.Unmarshal(b, &file); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %s", path)
+	}
+
+	for i, d := range file.Tunnels {
+		switch {
+		case d.Dial == "":
+			return nil, errors.Errorf("%s: tunnel #%d: dial address is required", path, i+1)
+		case (d.AgentUUID == "") == (len(d.AgentSelector) == 0):
+			return nil, errors.Errorf("%s: tunnel #%d: either agent UUID or agent selector is required", path, i+1)
+		case d.Weight < 0:
+			return nil, errors.Errorf("%s: tunnel #%d: invalid weight %d", path, i+1, d.Weight)
+		}
+	}
+	return &Manager{
+		decls:  file.Tunnels,
+		errors: make(map[key]string),
+	}, nil
+}
+
+// match returns declarations for agent's session by dial address.
+func (m *Manager) match(s *tunnel.Service) map[string]Declaration {
+	res := make(map[string]Declaration)
+	for _, d := range m.decls {
+		if d.Matches(s.UUID(), s.Labels()) {
+			if _, ok := res[d.Dial]; !ok {
+				res[d.Dial] = d
+			}
+		}
+	}
+	return res
+}
+
+// Declared returns true if tunnel to given dial address is declared for agent's session.
+func (m *Manager) Declared(s *tunnel.Service, dial string) bool {
+	_, ok := m.match(s)[dial]
+	return ok
+}
+
+// Apply creates declared tunnels missing in agent's session.
+func (m *Manager) Apply(s *tunnel.Service) {
+	m.applyM.Lock()
+	defer m.applyM.Unlock()
+
+	existing := make(map[string]bool)
+	for _, t := range s.Tunnels() {
+		existing[t.Dial()] = true
+	}
+
+	for dial, d := range m.match(s) {
+		if existing[dial] {
+			continue
+		}
+
+		k := key{s.UUID(), dial}
+		t, err := s.OpenTunnel(dial, tunnel.TunnelOptions{
+			Weight:      d.Weight,
+			ServiceType: d.ServiceType,
+		})
+		m.m.Lock()
+		if err != nil {
+			m.errors[k] = err.Error()
+		} else {
+			delete(m.errors, k)
+		}
+		m.m.Unlock()
+		if err != nil {
+			logrus.Errorf("Failed to create declared tunnel to %s via agent %q: %s.", dial, s.UUID(), err)
+			continue
+		}
+		logrus.Infof("Tunnel %s: created from declaration.", t.ID())
+	}
+}
+
+// Drift returns differences between declared tunnels and actual tunnels of connected agents,
+// sorted by agent UUID and dial address.
+func (m *Manager) Drift(registry *tunnel.Registry) []Drift {
+	m.m.Lock()
+	defer m.m.Unlock()
+
+	var res []Drift
+	connected := make(map[string]bool)
+	for _, s := range registry.Services() {
+		connected[s.UUID()] = true
+		declared := m.match(s)
+		existing := make(map[string]bool)
+		for _, t := range s.Tunnels() {
+			existing[t.Dial()] = true
+			if _, ok := declared[t.Dial()]; !ok {
+				res = append(res, Drift{
+					AgentUUID: s.UUID(),
+					Dial:      t.Dial(),
+					State:     DriftUndeclared,
+					TunnelID:  t.ID(),
+				})
+			}
+		}
+		for dial := range declared {
+			if !existing[dial] {
+				res = append(res, Drift{
+					AgentUUID: s.UUID(),
+					Dial:      dial,
+					State:     DriftMissing,
+					Error:     m.errors[key{s.UUID(), dial}],
+				})
+			}
+		}
+	}
+
+	for _, d := range m.decls {
+		if d.AgentUUID != "" && !connected[d.AgentUUID] {
+			res = append(res, Drift{
+				AgentUUID: d.AgentUUID,
+				Dial:      d.Dial,
+				State:     DriftAgentDisconnected,
+			})
+		}
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].AgentUUID != res[j].AgentUUID {
+			return res[i].AgentUUID < res[j].AgentUUID
+		}
+		return res[i].Dial < res[j].Dial
+	})
+	return res
+}
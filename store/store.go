@@ -0,0 +1,273 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+// Package store persists gateway state in an embedded bolt database: known agents,
+// persistent tunnel definitions, tunnel port allocations and CA enrollment records.
+package store
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/Percona-Lab/pmm-gateway/ca"
+	"github.com/Percona-Lab/pmm-gateway/ports"
+	"github.com/Percona-Lab/pmm-gateway/tunnel"
+)
+
+var (
+	agentsBucket     = []byte("agents")     // agent UUID -> Agent
+	tunnelsBucket    = []byte("tunnels")    // tunnel ID -> tunnel.Definition
+	portsBucket      = []byte("ports")      // port -> ports.Allocation
+	enrollmentBucket = []byte("enrollment") // caStateKey -> CA state
+
+	caStateKey = []byte("ca_state")
+)
+
+// Agent represents known agent: one that was connected at least once.
+type Agent struct {
+	UUID        string            `json:"uuid"`
+	Hostname    string            `json:"hostname,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	RemoteAddr  string            `json:"remote_addr"`
+	FirstSeenAt time.Time         `json:"first_seen_at"`
+	LastSeenAt  time.Time         `json:"last_seen_at"`
+	Evicted     bool              `json:"evicted,omitempty"` // the last session was evicted, see tunnel.Service.Evicted
+}
+
+// Store is a gateway state store. All methods are safe for concurrent use.
+type Store struct {
+	db *bolt.DB
+}
+
+// Open opens store in given file, creating it if needed.
+func Open(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open %s", path)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{agentsBucket, tunnelsBucket, portsBucket, enrollmentBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Store{db: db}, nil
+}
+
+// Close closes store.
+func (s *Store) Close() error {
+	return errors.WithStack(s.db.Close())
+}
+
+// put stores JSON-encoded value in bucket.
+func put(tx *bolt.Tx, bucket, key []byte, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	return errors.WithStack(tx.Bucket(bucket).Put(key, b))
+}
+
+// SaveAgent saves known agent record. FirstSeenAt of existing record is kept.
+func (s *Store) SaveAgent(agent *Agent) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		a := *agent
+		if b := tx.Bucket(agentsBucket).Get([]byte(a.UUID)); b != nil {
+			var old Agent
+			if err := json.Unmarshal(b, &old); err != nil {
+				return errors.Wrapf(err, "failed to decode agent %q", a.UUID)
+			}
+			a.FirstSeenAt = old.FirstSeenAt
+		}
+		return put(tx, agentsBucket, []byte(a.UUID), &a)
+	})
+}
+
+// Agents returns all known agents sorted by UUID.
+func (s *Store) Agents() ([]Agent, error) {
+	var res []Agent
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(agentsBucket).ForEach(func(k, v []byte) error {
+			var a Agent
+			if err := json.Unmarshal(v, &a); err != nil {
+				return errors.Wrapf(err, "failed to decode agent %q", k)
+			}
+			res = append(res, a)
+			return nil
+		})
+	})
+	return res, err
+}
+
+// DeleteAgent deletes known agent record, agent's tunnel definitions and port allocations.
+func (s *Store) DeleteAgent(uuid string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(agentsBucket)
+		if b.Get([]byte(uuid)) == nil {
+			return errors.Errorf("unknown agent %q", uuid)
+		}
+		if err := b.Delete([]byte(uuid)); err != nil {
+			return errors.WithStack(err)
+		}
+
+		defs, err := tunnels(tx, uuid)
+		if err != nil {
+			return err
+		}
+		for _, def := range defs {
+			if err = tx.Bucket(tunnelsBucket).Delete([]byte(def.ID)); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+
+		// keys can't be deleted during iteration
+		var keys [][]byte
+		pb := tx.Bucket(portsBucket)
+		err = pb.ForEach(func(k, v []byte) error {
+			var al ports.Allocation
+			if err := json.Unmarshal(v, &al); err != nil {
+				return errors.Wrapf(err, "failed to decode port %s allocation", k)
+			}
+			if al.AgentUUID == uuid {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err = pb.Delete(k); err != nil {
+				return errors.WithStack(err)
+			}
+		}
+		return nil
+	})
+}
+
+// SaveTunnel implements tunnel.DefinitionStore.
+func (s *Store) SaveTunnel(def *tunnel.Definition) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return put(tx, tunnelsBucket, []byte(def.ID), def)
+	})
+}
+
+// DeleteTunnel implements tunnel.DefinitionStore.
+func (s *Store) DeleteTunnel(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return errors.WithStack(tx.Bucket(tunnelsBucket).Delete([]byte(id)))
+	})
+}
+
+// Tunnels implements tunnel.DefinitionStore. Definitions are sorted by creation time.
+func (s *Store) Tunnels(agentUUID string) ([]*tunnel.Definition, error) {
+	var res []*tunnel.Definition
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		res, err = tunnels(tx, agentUUID)
+		return err
+	})
+	return res, err
+}
+
+// tunnels returns definitions of given agent's tunnels sorted by creation time.
+func tunnels(tx *bolt.Tx, agentUUID string) ([]*tunnel.Definition, error) {
+	var res []*tunnel.Definition
+	err := tx.Bucket(tunnelsBucket).ForEach(func(k, v []byte) error {
+		def := new(tunnel.Definition)
+		if err := json.Unmarshal(v, def); err != nil {
+			return errors.Wrapf(err, "failed to decode tunnel %s", k)
+		}
+		if def.AgentUUID == agentUUID {
+			res = append(res, def)
+		}
+		return nil
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].CreatedAt.Before(res[j].CreatedAt) })
+	return res, err
+}
+
+// LoadAllocations implements ports.Storage.
+func (s *Store) LoadAllocations() ([]ports.Allocation, error) {
+	var res []ports.Allocation
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(portsBucket).ForEach(func(k, v []byte) error {
+			var al ports.Allocation
+			if err := json.Unmarshal(v, &al); err != nil {
+				return errors.Wrapf(err, "failed to decode port %s allocation", k)
+			}
+			res = append(res, al)
+			return nil
+		})
+	})
+	return res, err
+}
+
+// SaveAllocations implements ports.Storage.
+func (s *Store) SaveAllocations(allocations []ports.Allocation) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(portsBucket); err != nil {
+			return errors.WithStack(err)
+		}
+		if _, err := tx.CreateBucket(portsBucket); err != nil {
+			return errors.WithStack(err)
+		}
+		for i := range allocations {
+			if err := put(tx, portsBucket, []byte(strconv.Itoa(allocations[i].Port)), &allocations[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// LoadCAState implements ca.Storage.
+func (s *Store) LoadCAState() ([]byte, error) {
+	var res []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(enrollmentBucket).Get(caStateKey); b != nil {
+			// value is valid only during transaction
+			res = append([]byte(nil), b...)
+		}
+		return nil
+	})
+	return res, err
+}
+
+// SaveCAState implements ca.Storage.
+func (s *Store) SaveCAState(b []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return errors.WithStack(tx.Bucket(enrollmentBucket).Put(caStateKey, b))
+	})
+}
+
+// check interfaces
+var (
+	_ tunnel.DefinitionStore = (*Store)(nil)
+	_ ports.Storage          = (*Store)(nil)
+	_ ca.Storage             = (*Store)(nil)
+)
@@ -0,0 +1,204 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package store
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Percona-Lab/pmm-gateway/ports"
+	"github.com/Percona-Lab/pmm-gateway/tunnel"
+)
+
+// setup opens a new store in temporary directory, and returns its path with a function removing it.
+func setup(t *testing.T) (string, func()) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "pmm-gateway-store-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "state.db"), func() { os.RemoveAll(dir) }
+}
+
+func TestRoundTrip(t *testing.T) {
+	path, teardown := setup(t)
+	defer teardown()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	agents := []Agent{
+		{UUID: "agent1", Hostname: "host1", Labels: map[string]string{"env": "prod"}, RemoteAddr: "10.0.0.1:1234",
+			FirstSeenAt: now, LastSeenAt: now},
+		{UUID: "agent2", RemoteAddr: "10.0.0.2:1234", FirstSeenAt: now, LastSeenAt: now, Evicted: true},
+	}
+	defs := []*tunnel.Definition{
+		{ID: "tunnel2", AgentUUID: "agent1", Dial: "127.0.0.1:3306", ServiceType: "mysql", CreatedAt: now.Add(-time.Hour)},
+		{ID: "tunnel1", AgentUUID: "agent1", Dial: "127.0.0.1:9100", Weight: 2, CreatedAt: now, ExpiresAt: now.Add(time.Hour)},
+		{ID: "tunnel3", AgentUUID: "agent2", Dial: "127.0.0.1:9100", CreatedAt: now},
+	}
+	allocations := []ports.Allocation{
+		{Port: 20000, AgentUUID: "agent1", Dial: "127.0.0.1:3306"},
+		{Port: 20001, AgentUUID: "agent1", Dial: "127.0.0.1:9100"},
+		{Port: 20002, AgentUUID: "agent2", Dial: "127.0.0.1:9100"},
+	}
+	caState := []byte(`{"tokens":{}}`)
+
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range agents {
+		if err = s.SaveAgent(&agents[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, def := range defs {
+		if err = s.SaveTunnel(def); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = s.SaveAllocations(allocations); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.SaveCAState(caState); err != nil {
+		t.Fatal(err)
+	}
+
+	// first seen time of existing agent is kept
+	again := agents[0]
+	again.FirstSeenAt = now.Add(time.Hour)
+	again.LastSeenAt = now.Add(time.Hour)
+	if err = s.SaveAgent(&again); err != nil {
+		t.Fatal(err)
+	}
+	agents[0].LastSeenAt = again.LastSeenAt
+	if err = s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopened store returns the same data
+	s, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	actualAgents, err := s.Agents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(agents, actualAgents) {
+		t.Errorf("expected agents %+v, got %+v", agents, actualAgents)
+	}
+	for _, tc := range []struct {
+		agentUUID string
+		expected  []*tunnel.Definition
+	}{
+		{"agent1", defs[:2]}, // sorted by creation time
+		{"agent2", defs[2:]},
+		{"agent3", nil},
+	} {
+		actual, err := s.Tunnels(tc.agentUUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tc.expected, actual) {
+			t.Errorf("agent %q: expected tunnels %+v, got %+v", tc.agentUUID, tc.expected, actual)
+		}
+	}
+	actualAllocations, err := s.LoadAllocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(allocations, actualAllocations) {
+		t.Errorf("expected allocations %v, got %v", allocations, actualAllocations)
+	}
+	actualCAState, err := s.LoadCAState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(actualCAState) != string(caState) {
+		t.Errorf("expected CA state %s, got %s", caState, actualCAState)
+	}
+}
+
+func TestDeleteAgent(t *testing.T) {
+	path, teardown := setup(t)
+	defer teardown()
+	s, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for _, uuid := range []string{"agent1", "agent2"} {
+		if err = s.SaveAgent(&Agent{UUID: uuid}); err != nil {
+			t.Fatal(err)
+		}
+		if err = s.SaveTunnel(&tunnel.Definition{ID: uuid + "-tunnel", AgentUUID: uuid, Dial: "127.0.0.1:9100"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = s.SaveAllocations([]ports.Allocation{
+		{Port: 20000, AgentUUID: "agent1", Dial: "127.0.0.1:9100"},
+		{Port: 20001, AgentUUID: "agent2", Dial: "127.0.0.1:9100"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.DeleteAgent("agent1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.DeleteAgent("agent1"); err == nil || err.Error() != `unknown agent "agent1"` {
+		t.Errorf("unexpected error %v", err)
+	}
+
+	agents, err := s.Agents()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 1 || agents[0].UUID != "agent2" {
+		t.Errorf("unexpected agents %+v", agents)
+	}
+	for _, tc := range []struct {
+		agentUUID string
+		tunnels   int
+	}{
+		{"agent1", 0},
+		{"agent2", 1},
+	} {
+		defs, err := s.Tunnels(tc.agentUUID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(defs) != tc.tunnels {
+			t.Errorf("agent %q: expected %d tunnels, got %+v", tc.agentUUID, tc.tunnels, defs)
+		}
+	}
+	allocations, err := s.LoadAllocations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allocations) != 1 || allocations[0].AgentUUID != "agent2" {
+		t.Errorf("unexpected allocations %v", allocations)
+	}
+}
@@ -0,0 +1,135 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tunnel
+
+import (
+	"net"
+	"sync"
+)
+
+// localConn is a local connection forwarded via agent's tunnel.
+//
+// Data is carried in both directions by frames of a single data stream of agent's connection.
+// Each direction is closed separately (TCP half-close): when local client finishes writing,
+// close write frame is sent to agent, and vice versa.
+// Connection is done when both directions are closed, when it is aborted by either side, or when it is closed
+// by gateway (session end, tunnel close).
+// Data from agent is queued and written by a separate goroutine, see writeQueue and sendWindow.
+type localConn struct {
+	net.Conn
+	streamID uint64
+	weight   int         // data stream scheduling weight
+	window   int         // gateway's receive window, and the limit of gateway's send credit
+	sendCut  uint32      // part of agent's initial window above the limit, not added to send credit
+	id       string      // agent's tunnel ID, set when agent accepted the stream
+	send     *sendWindow // gateway -> agent credit
+	queue    *writeQueue // agent -> gateway data
+
+	// session resumption state, see session.go
+	sendM          sync.Mutex // serializes frames sent to agent with session resume
+	granted        uint64     // total window granted to agent; guarded by sendM
+	replayM        sync.Mutex
+	sent           uint64 // data bytes sent to agent
+	acked          uint64 // data bytes acknowledged by agent
+	replay         []byte // sent and not acknowledged data, if session is resumable
+	replayOverflow bool   // replay buffer limit was exceeded, stream can't be resumed
+	closeWriteSent bool
+	received       uint64 // atomic, data bytes received from agent plus 1 after close write
+	ackSent        uint64 // the last acknowledged received value; accessed by frame handler only
+
+	m         sync.Mutex
+	readDone  bool // local client finished writing, agent was notified
+	writeDone bool // agent finished writing, local connection write side is closed
+	aborted   bool // connection was closed by agent, or agent was already notified about failure
+	doneOnce  sync.Once
+	done      chan struct{}
+}
+
+// newLocalConn creates a new connection for given data stream with given scheduling weight and window.
+// Agent's receive window is empty until agent accepts the stream.
+func newLocalConn(streamID uint64, c net.Conn, weight, window int) *localConn {
+	return &localConn{
+		Conn:     c,
+		streamID: streamID,
+		weight:   weight,
+		window:   window,
+		send:     newSendWindow(),
+		queue:    newWriteQueue(window),
+		granted:  uint64(window),
+		done:     make(chan struct{}),
+	}
+}
+
+// Close closes local connection, marks it done, and wakes up goroutines waiting for window or queued data.
+func (c *localConn) Close() error {
+	c.markDone()
+	c.send.close()
+	c.queue.close()
+	return c.Conn.Close()
+}
+
+func (c *localConn) markDone() {
+	c.doneOnce.Do(func() { close(c.done) })
+}
+
+// finishRead marks read direction as done. It returns true if write direction is done too.
+func (c *localConn) finishRead() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.readDone = true
+	if c.writeDone {
+		c.markDone()
+	}
+	return c.writeDone
+}
+
+// closeWrite closes write side of local connection.
+func (c *localConn) closeWrite() error {
+	var err error
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		err = cw.CloseWrite()
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.writeDone = true
+	if c.readDone {
+		c.markDone()
+	}
+	return err
+}
+
+// abort closes local connection on agent's request or on write error.
+func (c *localConn) abort() error {
+	c.m.Lock()
+	c.aborted = true
+	c.markDone()
+	c.m.Unlock()
+
+	return c.Close()
+}
+
+func (c *localConn) isAborted() bool {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	return c.aborted
+}
@@ -0,0 +1,81 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tunnel
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Definition contains persistent tunnel's parameters.
+type Definition struct {
+	ID          string    `json:"id"`
+	AgentUUID   string    `json:"agent_uuid"`
+	Dial        string    `json:"dial"`
+	Weight      int       `json:"weight,omitempty"`
+	ServiceType string    `json:"service_type,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at,omitempty"` // zero if tunnel has no TTL
+}
+
+// DefinitionStore persists definitions of persistent tunnels.
+type DefinitionStore interface {
+	// SaveTunnel saves tunnel definition.
+	SaveTunnel(def *Definition) error
+
+	// DeleteTunnel deletes tunnel definition by tunnel ID. It does nothing if there is no such definition.
+	DeleteTunnel(id string) error
+
+	// Tunnels returns definitions of given agent's tunnels.
+	Tunnels(agentUUID string) ([]*Definition, error)
+}
+
+// RestoreTunnels creates agent's persistent tunnels from saved definitions with the same IDs,
+// unless they already exist. Expired definitions are deleted.
+func (s *Service) RestoreTunnels() {
+	ds := s.registry.definitionStore()
+	if ds == nil {
+		return
+	}
+	defs, err := ds.Tunnels(s.UUID())
+	if err != nil {
+		logrus.Errorf("Failed to load tunnel definitions for agent %q: %s.", s.UUID(), err)
+		return
+	}
+
+	now := time.Now()
+	for _, def := range defs {
+		if s.Tunnel(def.ID) != nil {
+			// attached after reconnect during grace period
+			continue
+		}
+		if !def.ExpiresAt.IsZero() && !def.ExpiresAt.After(now) {
+			logrus.Infof("Tunnel %s: TTL expired while agent %q was disconnected.", def.ID, s.UUID())
+			if err = ds.DeleteTunnel(def.ID); err != nil {
+				logrus.Errorf("Tunnel %s: failed to delete definition: %s.", def.ID, err)
+			}
+			continue
+		}
+
+		if _, err = s.openTunnel(def, true); err != nil {
+			logrus.Errorf("Tunnel %s: failed to restore tunnel to %s via agent %q: %s.", def.ID, def.Dial, s.UUID(), err)
+			continue
+		}
+		logrus.Infof("Tunnel %s: restored.", def.ID)
+	}
+}
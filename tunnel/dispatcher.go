@@ -0,0 +1,243 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tunnel
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Percona-Lab/pmm-api/gateway"
+	"github.com/Percona-Lab/wsrpc"
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultWorkers is the default number of dispatcher workers per agent session.
+const DefaultWorkers = 16
+
+// Reasons of Dispatcher.Run exit returned by Dispatcher.ExitReason.
+const (
+	ExitConnectionClosed = "connection_closed" // connection was closed by either side, or failed
+	ExitProtocolError    = "protocol_error"    // unexpected or malformed request
+	ExitHandlerError     = "handler_error"     // request handler returned error
+)
+
+// call is a decoded gateway request.
+type call struct {
+	message  *wsrpc.Message
+	handle   func() (proto.Message, error)
+	received time.Time
+}
+
+// callQueue contains requests for the same tunnel; they are handled by a single worker in order.
+type callQueue struct {
+	tunnelID string // empty for requests not bound to tunnel
+	calls    []*call
+}
+
+// Dispatcher reads gateway requests from agent's connection and handles them concurrently
+// with a bounded pool of workers, unlike generated gateway.ServiceDispatcher which handles
+// one request at a time. Requests for the same tunnel ID are handled in order they were received.
+type Dispatcher struct {
+	conn    *wsrpc.Conn
+	server  gateway.ServiceServer
+	workers int
+	work    chan *callQueue
+
+	m          sync.Mutex
+	queues     map[string]*callQueue // tunnel ID -> queue waiting for or being handled by worker
+	err        error                 // first handler error
+	exitReason string
+}
+
+// NewDispatcher creates a new dispatcher with given number of workers.
+func NewDispatcher(conn *wsrpc.Conn, server gateway.ServiceServer, workers int) *Dispatcher {
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+	return &Dispatcher{
+		conn:    conn,
+		server:  server,
+		workers: workers,
+		work:    make(chan *callQueue, workers),
+		queues:  make(map[string]*callQueue),
+	}
+}
+
+// Run reads and dispatches requests until connection is closed or handler returns error.
+func (d *Dispatcher) Run() error {
+	var wg sync.WaitGroup
+	wg.Add(d.workers)
+	for i := 0; i < d.workers; i++ {
+		go func() {
+			defer wg.Done()
+			for q := range d.work {
+				d.runQueue(q)
+			}
+		}()
+	}
+
+	exitErr := d.runReader()
+	close(d.work)
+	wg.Wait()
+
+	d.m.Lock()
+	if d.err != nil {
+		exitErr = d.err
+	}
+	d.m.Unlock()
+	return exitErr
+}
+
+// ExitReason returns the reason of Run exit, see Exit* constants. It should be called after Run returns.
+func (d *Dispatcher) ExitReason() string {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	return d.exitReason
+}
+
+// setExitReason sets exit reason unless it is already set.
+func (d *Dispatcher) setExitReason(reason string) {
+	d.m.Lock()
+	if d.exitReason == "" {
+		d.exitReason = reason
+	}
+	d.m.Unlock()
+}
+
+func (d *Dispatcher) runReader() error {
+	for {
+		message, err := d.conn.Read()
+		if err != nil {
+			d.setExitReason(ExitConnectionClosed)
+			return fmt.Errorf("failed to read message: %s", err)
+		}
+
+		tunnelID, handle, err := decodeRequest(d.server, message)
+		if err != nil {
+			d.setExitReason(ExitProtocolError)
+			d.conn.Close()
+			return err
+		}
+		c := &call{
+			message:  message,
+			handle:   handle,
+			received: time.Now(),
+		}
+		dispatcherQueuedG.Inc()
+
+		d.m.Lock()
+		if q := d.queues[tunnelID]; q != nil {
+			q.calls = append(q.calls, c)
+			d.m.Unlock()
+			continue
+		}
+		q := &callQueue{
+			tunnelID: tunnelID,
+			calls:    []*call{c},
+		}
+		if tunnelID != "" {
+			d.queues[tunnelID] = q
+		}
+		d.m.Unlock()
+
+		// blocks when all workers are busy
+		d.work <- q
+	}
+}
+
+// runQueue handles requests from queue until it is empty.
+func (d *Dispatcher) runQueue(q *callQueue) {
+	for {
+		d.m.Lock()
+		if len(q.calls) == 0 {
+			if q.tunnelID != "" {
+				delete(d.queues, q.tunnelID)
+			}
+			d.m.Unlock()
+			return
+		}
+		c := q.calls[0]
+		q.calls[0] = nil
+		q.calls = q.calls[1:]
+		d.m.Unlock()
+		dispatcherQueuedG.Dec()
+
+		d.handle(c)
+	}
+}
+
+func (d *Dispatcher) handle(c *call) {
+	res, err := c.handle()
+	var b []byte
+	if err == nil {
+		b, err = proto.Marshal(res)
+	}
+	if err != nil {
+		rpcDurationV.WithLabelValues(c.message.Path, rpcResult(err)).Observe(time.Since(c.received).Seconds())
+		d.setExitReason(ExitHandlerError)
+		d.m.Lock()
+		if d.err == nil {
+			d.err = fmt.Errorf("%s returned error: %s", c.message.Path, err)
+		}
+		d.m.Unlock()
+		d.conn.Close()
+		return
+	}
+
+	err = d.conn.Write(&wsrpc.Message{
+		StreamID: c.message.StreamID,
+		Path:     c.message.Path,
+		Arg:      b,
+	})
+	rpcDurationV.WithLabelValues(c.message.Path, rpcResult(err)).Observe(time.Since(c.received).Seconds())
+	if err != nil {
+		logrus.Warnf("Failed to write %s response: %s.", c.message.Path, err)
+	}
+}
+
+// decodeRequest unmarshals request and returns its tunnel ID (empty if requests
+// should not be ordered) and a function calling server's method.
+func decodeRequest(server gateway.ServiceServer, message *wsrpc.Message) (string, func() (proto.Message, error), error) {
+	var req proto.Message
+	switch message.Path {
+	case "/gateway.Service/CreateTunnel":
+		req = new(gateway.CreateTunnelRequest)
+	case "/gateway.Service/WriteToTunnel":
+		req = new(gateway.WriteToTunnelRequest)
+	case "/gateway.Service/CloseTunnel":
+		req = new(gateway.CloseTunnelRequest)
+	default:
+		return "", nil, fmt.Errorf("unexpected path %q", message.Path)
+	}
+	if err := proto.Unmarshal(message.Arg, req); err != nil {
+		return "", nil, fmt.Errorf("failed to unmarshal protobuf message to %T: %s", req, err)
+	}
+
+	switch req := req.(type) {
+	case *gateway.CreateTunnelRequest:
+		return "", func() (proto.Message, error) { return server.CreateTunnel(req) }, nil
+	case *gateway.WriteToTunnelRequest:
+		return req.TunnelId, func() (proto.Message, error) { return server.WriteToTunnel(req) }, nil
+	case *gateway.CloseTunnelRequest:
+		return req.TunnelId, func() (proto.Message, error) { return server.CloseTunnel(req) }, nil
+	default:
+		panic(fmt.Sprintf("unhandled request type %T", req))
+	}
+}
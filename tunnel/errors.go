@@ -0,0 +1,66 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tunnel
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Percona-Lab/pmm-api/agent"
+	"github.com/pkg/errors"
+)
+
+// Error is a tunnel error with code for programmatic handling.
+type Error struct {
+	Code    agent.ErrorCode
+	Message string
+}
+
+// Error implements error interface.
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// callError returns Error for agent's RPC call error, or for error returned by agent in response.
+func callError(err error, resError string, resCode agent.ErrorCode) *Error {
+	if err == nil {
+		return &Error{
+			Code:    resCode,
+			Message: resError,
+		}
+	}
+
+	code := agent.ErrorCode_AGENT_UNAVAILABLE
+	if errors.Cause(err) == context.DeadlineExceeded {
+		code = agent.ErrorCode_TIMEOUT
+	}
+	return &Error{
+		Code:    code,
+		Message: err.Error(),
+	}
+}
+
+// wrap returns a copy of e with message prefixed by formatted string.
+func (e *Error) wrap(format string, args ...interface{}) *Error {
+	return &Error{
+		Code:    e.Code,
+		Message: fmt.Sprintf(format, args...) + ": " + e.Message,
+	}
+}
+
+// check interfaces
+var _ error = (*Error)(nil)
@@ -0,0 +1,132 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tunnel
+
+// Legacy protocol
+//
+// Agents released before data stream frames were introduced do not send ProtocolHeader.
+// They carry tunnel data with WriteToTunnel RPCs in both directions, one request per chunk,
+// and implement only CreateTunnel and WriteToTunnel agent's methods. There is no flow control
+// other than waiting for RPC response, no half-close, and gateway can't ask agent to close its side
+// of tunnel. Legacy sessions are not resumable.
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/Percona-Lab/pmm-api/agent"
+	"github.com/Percona-Lab/pmm-api/gateway"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// ProtocolHeader contains tunnel protocol version supported by agent. Gateway responds with
+	// the same value if it uses that version.
+	ProtocolHeader = "Pmm-Tunnel-Protocol"
+
+	// ProtocolFrames is a ProtocolHeader value of agents using data stream frames.
+	// Agents without ProtocolHeader use legacy protocol, see package documentation.
+	ProtocolFrames = "2"
+
+	// legacyConnWait is the maximal time to wait for local connection registration when legacy agent
+	// writes to it right after CreateTunnel response.
+	legacyConnWait = time.Second
+)
+
+// forwardLegacy forwards data from local connection to legacy agent until either side fails or closes it.
+// Data from agent is written by WriteToTunnel.
+func (s *Service) forwardLegacy(c *localConn) {
+	for {
+		b, err := s.readChunk(c, chunkSize)
+		if len(b) != 0 {
+			if wErr := s.writeLegacy(c, b); wErr != nil {
+				if !c.isAborted() {
+					logrus.Errorf("Tunnel %s: %s.", c.id, wErr)
+				}
+				return
+			}
+			s.stats.addToAgent(len(b))
+		}
+		if err != nil {
+			if err != io.EOF && !c.isAborted() {
+				logrus.Errorf("Tunnel %s: %s.", c.id, err)
+			}
+			return
+		}
+	}
+}
+
+// writeLegacy sends data to legacy agent with WriteToTunnel RPC.
+func (s *Service) writeLegacy(c *localConn, b []byte) error {
+	ctx, cancel := s.rpcContext("WriteToTunnel")
+	defer cancel()
+
+	res, err := s.getClient().WriteToTunnel(ctx, &agent.WriteToTunnelRequest{
+		TunnelId: c.id,
+		Data:     b,
+	})
+	if err != nil {
+		return err
+	}
+	if res.Error != "" {
+		return fmt.Errorf("agent failed to write to tunnel: %s", res.Error)
+	}
+	return nil
+}
+
+// legacyConn returns local connection by agent's tunnel ID. It waits a bit if it is not registered yet.
+func (s *Service) legacyConn(tunnelID string) *localConn {
+	timer := time.NewTimer(legacyConnWait)
+	defer timer.Stop()
+
+	for {
+		s.rw.RLock()
+		c, registered := s.conns[tunnelID], s.connRegistered
+		s.rw.RUnlock()
+		if c != nil {
+			return c
+		}
+
+		select {
+		case <-registered:
+		case <-timer.C:
+			return nil
+		case <-s.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// WriteToTunnel writes data from legacy agent to local connection.
+func (s *Service) WriteToTunnel(req *gateway.WriteToTunnelRequest) (*gateway.WriteToTunnelResponse, error) {
+	c := s.legacyConn(req.TunnelId)
+	if c == nil {
+		return &gateway.WriteToTunnelResponse{
+			Error: fmt.Sprintf("no such tunnel: %s", req.TunnelId),
+		}, nil
+	}
+
+	s.stats.addFromAgent(len(req.Data))
+	if _, err := c.Conn.Write(req.Data); err != nil {
+		c.abort()
+		return &gateway.WriteToTunnelResponse{
+			Error: err.Error(),
+		}, nil
+	}
+	return &gateway.WriteToTunnelResponse{}, nil
+}
@@ -0,0 +1,126 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Percona-Lab/pmm-api/agent"
+	"github.com/Percona-Lab/pmm-api/gateway"
+	"github.com/Percona-Lab/wsrpc"
+
+	"github.com/Percona-Lab/pmm-gateway/auth"
+)
+
+// legacyAgent is an agent without data stream frames support. It echoes tunnel data back to gateway.
+type legacyAgent struct {
+	t      *testing.T
+	client gateway.ServiceClient
+	dials  chan string
+}
+
+func (a *legacyAgent) CreateTunnel(req *agent.CreateTunnelRequest) (*agent.CreateTunnelResponse, error) {
+	if req.Window != 0 || req.StreamId != 0 {
+		a.t.Errorf("unexpected request %v", req)
+	}
+	a.dials <- req.Dial
+	return &agent.CreateTunnelResponse{TunnelId: "tunnel1"}, nil
+}
+
+func (a *legacyAgent) WriteToTunnel(req *agent.WriteToTunnelRequest) (*agent.WriteToTunnelResponse, error) {
+	res, err := a.client.WriteToTunnel(context.Background(), &gateway.WriteToTunnelRequest{
+		TunnelId: req.TunnelId,
+		Data:     req.Data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &agent.WriteToTunnelResponse{Error: res.Error}, nil
+}
+
+func (a *legacyAgent) CloseTunnel(req *agent.CloseTunnelRequest) (*agent.CloseTunnelResponse, error) {
+	a.t.Errorf("unexpected request %v", req)
+	return nil, fmt.Errorf("not implemented")
+}
+
+func TestLegacy(t *testing.T) {
+	gwConns := make(chan *wsrpc.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, err := wsrpc.Upgrade(rw, req, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		gwConns <- conn
+	}))
+	defer server.Close()
+
+	agentConn, _, err := wsrpc.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agentConn.Close()
+	a := &legacyAgent{
+		t:      t,
+		client: gateway.NewServiceClient(agentConn),
+		dials:  make(chan string, 1),
+	}
+	go agent.NewServiceDispatcher(agentConn, a).Run()
+
+	gwConn := <-gwConns
+	svc := NewService(&auth.Identity{AgentUUID: "agent1"}, "test", gwConn, nil, Config{Legacy: true})
+	defer gwConn.Close()
+	go NewDispatcher(gwConn, svc, 2).Run()
+
+	c, err := svc.Dial("127.0.0.1:9100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if dial := <-a.dials; dial != "127.0.0.1:9100" {
+		t.Errorf("unexpected dial address %q", dial)
+	}
+
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	for _, s := range []string{"hello", "world"} {
+		if _, err = c.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+		b := make([]byte, len(s))
+		if _, err = io.ReadFull(c, b); err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != s {
+			t.Errorf("expected %q, got %q", s, b)
+		}
+	}
+
+	res, err := svc.WriteToTunnel(&gateway.WriteToTunnelRequest{TunnelId: "tunnel2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Error != "no such tunnel: tunnel2" {
+		t.Errorf("unexpected error %q", res.Error)
+	}
+}
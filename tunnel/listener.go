@@ -0,0 +1,269 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tunnel
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Percona-Lab/pmm-api/agent"
+)
+
+// Tunnel represents local listener; each accepted connection is forwarded via agent to dial address.
+type Tunnel struct {
+	id          string
+	agentUUID   string
+	dial        string
+	weight      int
+	serviceType string
+	persistent  bool
+	createdAt   time.Time
+	expiresAt   time.Time // zero if tunnel has no TTL
+	l           net.Listener
+	ttlTimer    *time.Timer
+
+	rw          sync.RWMutex
+	svc         *Service              // owning agent's session; nil while tunnel is detached
+	hostname    string                // owning agent's hostname, kept while tunnel is detached
+	attached    chan struct{}         // closed when tunnel is attached to session or closed
+	conns       map[string]*localConn // agent's tunnel ID -> local connection
+	closed      bool
+	lastError   *Error
+	lastErrorAt time.Time
+	errors      map[agent.ErrorCode]int // error code -> number of errors
+}
+
+// Conn contains information about tunnel's live connection.
+type Conn struct {
+	AgentTunnelID string
+	RemoteAddr    string
+}
+
+// ID returns tunnel ID.
+func (t *Tunnel) ID() string {
+	return t.id
+}
+
+// AgentUUID returns UUID of agent owning this tunnel.
+func (t *Tunnel) AgentUUID() string {
+	return t.agentUUID
+}
+
+// CreatedAt returns tunnel creation time.
+func (t *Tunnel) CreatedAt() time.Time {
+	return t.createdAt
+}
+
+// ExpiresAt returns time when tunnel will be deleted automatically, or zero time if there is no TTL.
+func (t *Tunnel) ExpiresAt() time.Time {
+	return t.expiresAt
+}
+
+// Dial returns address dialed by agent.
+func (t *Tunnel) Dial() string {
+	return t.dial
+}
+
+// Weight returns tunnel's share of agent's connection relative to other tunnels.
+func (t *Tunnel) Weight() int {
+	return t.weight
+}
+
+// ServiceType returns the type of service behind tunnel, or empty string.
+func (t *Tunnel) ServiceType() string {
+	return t.serviceType
+}
+
+// Persistent returns true if tunnel is restored when agent reconnects, see TunnelOptions.
+func (t *Tunnel) Persistent() bool {
+	return t.persistent
+}
+
+// Hostname returns owning agent's hostname. While tunnel is detached, it returns the last known one.
+func (t *Tunnel) Hostname() string {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+
+	return t.hostname
+}
+
+// Listen returns local listen address.
+func (t *Tunnel) Listen() string {
+	return t.l.Addr().String()
+}
+
+// LastError returns the last error of connection forwarding via agent and its time,
+// or nil and zero time if there were no errors.
+func (t *Tunnel) LastError() (*Error, time.Time) {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+
+	return t.lastError, t.lastErrorAt
+}
+
+// Errors returns the number of connection forwarding errors by error code.
+func (t *Tunnel) Errors() map[agent.ErrorCode]int {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+
+	res := make(map[agent.ErrorCode]int, len(t.errors))
+	for code, n := range t.errors {
+		res[code] = n
+	}
+	return res
+}
+
+func (t *Tunnel) setError(err *Error) {
+	t.rw.Lock()
+	t.lastError = err
+	t.lastErrorAt = time.Now()
+	t.errors[err.Code]++
+	t.rw.Unlock()
+
+	tunnelErrorsV.WithLabelValues(err.Code.String()).Inc()
+}
+
+// Conns returns live connections sorted by agent's tunnel ID.
+func (t *Tunnel) Conns() []Conn {
+	t.rw.RLock()
+	res := make([]Conn, 0, len(t.conns))
+	for id, c := range t.conns {
+		res = append(res, Conn{
+			AgentTunnelID: id,
+			RemoteAddr:    c.RemoteAddr().String(),
+		})
+	}
+	t.rw.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].AgentTunnelID < res[j].AgentTunnelID })
+	return res
+}
+
+// AgentConnected returns true if tunnel is attached to agent's session, false if it is detached.
+func (t *Tunnel) AgentConnected() bool {
+	return t.service() != nil
+}
+
+// service returns owning agent's session, or nil if tunnel is detached.
+func (t *Tunnel) service() *Service {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+
+	return t.svc
+}
+
+// waitService returns owning agent's session, waiting up to timeout for detached tunnel to be attached.
+// It returns nil if tunnel is still detached or closed.
+func (t *Tunnel) waitService(timeout time.Duration) *Service {
+	t.rw.RLock()
+	s, attached, closed := t.svc, t.attached, t.closed
+	t.rw.RUnlock()
+	if s != nil || closed || timeout == 0 {
+		return s
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-attached:
+		return t.service()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// attach sets owning agent's session.
+func (t *Tunnel) attach(s *Service) {
+	t.rw.Lock()
+	defer t.rw.Unlock()
+
+	if t.svc == nil && !t.closed {
+		close(t.attached)
+	}
+	t.svc = s
+	t.hostname = s.Hostname()
+}
+
+// detach clears owning agent's session. New local connections will wait for attach.
+func (t *Tunnel) detach() {
+	t.rw.Lock()
+	defer t.rw.Unlock()
+
+	if t.svc != nil && !t.closed {
+		t.svc = nil
+		t.attached = make(chan struct{})
+	}
+}
+
+// addConn adds live connection. It returns false if tunnel is already closed.
+func (t *Tunnel) addConn(c *localConn) bool {
+	t.rw.Lock()
+	defer t.rw.Unlock()
+
+	if t.closed {
+		return false
+	}
+	t.conns[c.id] = c
+	return true
+}
+
+func (t *Tunnel) removeConn(id string) {
+	t.rw.Lock()
+	delete(t.conns, id)
+	t.rw.Unlock()
+}
+
+func (t *Tunnel) isClosed() bool {
+	t.rw.RLock()
+	defer t.rw.RUnlock()
+
+	return t.closed
+}
+
+// close closes listener and all live connections.
+func (t *Tunnel) close() {
+	t.rw.Lock()
+	defer t.rw.Unlock()
+
+	if t.closed {
+		return
+	}
+	t.closed = true
+	if t.svc == nil {
+		close(t.attached) // wake up waiters
+	}
+	if t.ttlTimer != nil {
+		t.ttlTimer.Stop()
+	}
+	t.l.Close()
+	for _, c := range t.conns {
+		c.Close()
+	}
+}
+
+// newID returns a new random ID.
+func newID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
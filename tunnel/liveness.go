@@ -0,0 +1,59 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tunnel
+
+import (
+	"time"
+)
+
+// Agent liveness states returned by Service.Liveness.
+const (
+	LivenessAlive        = "alive"        // pong was received for the last ping
+	LivenessUnresponsive = "unresponsive" // some pongs were missed
+	LivenessSuspended    = "suspended"    // connection broke, session is waiting for resume
+	LivenessDead         = "dead"         // too many pongs were missed, session is evicted and removed from registry
+)
+
+// LastPong returns the time of the last pong received from agent, or zero time if there was none yet.
+func (s *Service) LastPong() time.Time {
+	return s.getConn().LastPong()
+}
+
+// MissedPongs returns the number of consecutive pings agent did not answer.
+func (s *Service) MissedPongs() int {
+	return s.getConn().MissedPongs()
+}
+
+// Evicted returns true if agent missed Config.MaxMissedPongs pongs, so its connection was closed
+// (half-open TCP connection is the usual cause). Evicted session is not resumed, and its tunnels are closed.
+func (s *Service) Evicted() bool {
+	return s.config.MaxMissedPongs > 0 && s.MissedPongs() >= s.config.MaxMissedPongs
+}
+
+// Liveness returns agent liveness state, see Liveness* constants.
+func (s *Service) Liveness() string {
+	switch {
+	case s.Evicted():
+		return LivenessDead
+	case s.Suspended():
+		return LivenessSuspended
+	case s.MissedPongs() > 0:
+		return LivenessUnresponsive
+	default:
+		return LivenessAlive
+	}
+}
@@ -0,0 +1,191 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tunnel
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/Percona-Lab/wsrpc"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace = "pmm_gateway"
+
+	// data stream directions for metrics labels
+	directionToAgent   = "to_agent"
+	directionFromAgent = "from_agent"
+)
+
+var (
+	rpcDurationV = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Duration of wsrpc calls made to agents and requests handled for agents, by path and result.",
+	}, []string{"path", "result"})
+
+	pingRTTH = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "ping_rtt_seconds",
+		Help:      "Round-trip time of agents' connections measured by WebSocket pings.",
+	})
+
+	dispatcherQueuedG = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "dispatcher_queued_requests",
+		Help:      "Number of received agents' requests waiting for dispatcher worker.",
+	})
+
+	tunnelErrorsV = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tunnel_errors_total",
+		Help:      "Number of connection forwarding errors by error code.",
+	}, []string{"code"})
+)
+
+func init() {
+	prometheus.MustRegister(rpcDurationV, pingRTTH, dispatcherQueuedG, tunnelErrorsV)
+}
+
+// rpcResult returns result label value for RPC error.
+func rpcResult(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+// connObserver updates metrics for events of agent's connection.
+type connObserver struct{}
+
+func (connObserver) ObservePong(rtt time.Duration) {
+	pingRTTH.Observe(rtt.Seconds())
+}
+
+func (connObserver) ObserveCall(path string, d time.Duration, err error) {
+	rpcDurationV.WithLabelValues(path, rpcResult(err)).Observe(d.Seconds())
+}
+
+// streamStats contains data stream counters of agent session.
+type streamStats struct {
+	bytesToAgent    uint64 // atomic
+	bytesFromAgent  uint64 // atomic
+	chunksToAgent   uint64 // atomic
+	chunksFromAgent uint64 // atomic
+}
+
+func (s *streamStats) addToAgent(n int) {
+	atomic.AddUint64(&s.bytesToAgent, uint64(n))
+	atomic.AddUint64(&s.chunksToAgent, 1)
+}
+
+func (s *streamStats) addFromAgent(n int) {
+	atomic.AddUint64(&s.bytesFromAgent, uint64(n))
+	atomic.AddUint64(&s.chunksFromAgent, 1)
+}
+
+var (
+	agentsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "agents"),
+		"Number of connected agents.",
+		nil, nil,
+	)
+	tunnelsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tunnels"),
+		"Number of active tunnels.",
+		[]string{"agent_uuid"}, nil,
+	)
+	tunnelConnsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tunnel_connections"),
+		"Number of live tunnel connections.",
+		[]string{"agent_uuid"}, nil,
+	)
+	tunnelBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tunnel_bytes_total"),
+		"Number of tunneled data bytes in agent's current session.",
+		[]string{"agent_uuid", "direction"}, nil,
+	)
+	tunnelChunksDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tunnel_chunks_total"),
+		"Number of tunneled data chunks (data stream frames) in agent's current session.",
+		[]string{"agent_uuid", "direction"}, nil,
+	)
+	agentPingRTTDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "agent_ping_rtt_seconds"),
+		"The last measured round-trip time of agent's connection.",
+		[]string{"agent_uuid"}, nil,
+	)
+	agentMissedPongsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "agent_missed_pongs"),
+		"The number of consecutive pings agent did not answer.",
+		[]string{"agent_uuid"}, nil,
+	)
+)
+
+// Describe implements prometheus.Collector.
+func (r *Registry) Describe(ch chan<- *prometheus.Desc) {
+	ch <- agentsDesc
+	ch <- tunnelsDesc
+	ch <- tunnelConnsDesc
+	ch <- tunnelBytesDesc
+	ch <- tunnelChunksDesc
+	ch <- agentPingRTTDesc
+	ch <- agentMissedPongsDesc
+}
+
+// Collect implements prometheus.Collector.
+func (r *Registry) Collect(ch chan<- prometheus.Metric) {
+	services := r.Services()
+	ch <- prometheus.MustNewConstMetric(agentsDesc, prometheus.GaugeValue, float64(len(services)))
+
+	for _, s := range services {
+		uuid := s.UUID()
+		tunnels := s.Tunnels()
+		var conns int
+		for _, t := range tunnels {
+			conns += len(t.Conns())
+		}
+		ch <- prometheus.MustNewConstMetric(tunnelsDesc, prometheus.GaugeValue, float64(len(tunnels)), uuid)
+		ch <- prometheus.MustNewConstMetric(tunnelConnsDesc, prometheus.GaugeValue, float64(conns), uuid)
+
+		st := &s.stats
+		for _, m := range []struct {
+			desc      *prometheus.Desc
+			direction string
+			value     *uint64
+		}{
+			{tunnelBytesDesc, directionToAgent, &st.bytesToAgent},
+			{tunnelBytesDesc, directionFromAgent, &st.bytesFromAgent},
+			{tunnelChunksDesc, directionToAgent, &st.chunksToAgent},
+			{tunnelChunksDesc, directionFromAgent, &st.chunksFromAgent},
+		} {
+			ch <- prometheus.MustNewConstMetric(m.desc, prometheus.CounterValue, float64(atomic.LoadUint64(m.value)), uuid, m.direction)
+		}
+
+		if rtt := s.Latency(); rtt > 0 {
+			ch <- prometheus.MustNewConstMetric(agentPingRTTDesc, prometheus.GaugeValue, rtt.Seconds(), uuid)
+		}
+		ch <- prometheus.MustNewConstMetric(agentMissedPongsDesc, prometheus.GaugeValue, float64(s.MissedPongs()), uuid)
+	}
+}
+
+// check interfaces
+var (
+	_ wsrpc.Observer       = connObserver{}
+	_ prometheus.Collector = (*Registry)(nil)
+)
@@ -0,0 +1,285 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tunnel
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// detached contains tunnels of disconnected agent kept during grace period.
+type detached struct {
+	tunnels map[string]*Tunnel // tunnel ID -> tunnel
+	timer   *time.Timer
+}
+
+// Registry keeps track of connected agents' services by agent UUID.
+// It is shared by all connections, so a request received on any of them can be routed to any agent.
+//
+// Tunnels are bound to agent UUID, not to agent's connection: when session ends, its tunnels are detached
+// and kept listening during grace period. If agent reconnects in time, they are attached to its new session.
+type Registry struct {
+	rw           sync.RWMutex
+	services     map[string]*Service
+	detached     map[string]*detached // agent UUID -> detached tunnels
+	defs         DefinitionStore
+	gracePeriod  time.Duration
+	queueTimeout time.Duration
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		services: make(map[string]*Service),
+		detached: make(map[string]*detached),
+	}
+}
+
+// SetGracePeriod sets the time disconnected agent's tunnels are kept listening (zero closes them immediately),
+// and the time new local connections wait for agent to reconnect (zero refuses them immediately).
+// It should be called before agents are connected.
+func (r *Registry) SetGracePeriod(gracePeriod, queueTimeout time.Duration) {
+	r.rw.Lock()
+	r.gracePeriod = gracePeriod
+	r.queueTimeout = queueTimeout
+	r.rw.Unlock()
+}
+
+// getQueueTimeout returns the time new local connections wait for disconnected agent.
+func (r *Registry) getQueueTimeout() time.Duration {
+	r.rw.RLock()
+	defer r.rw.RUnlock()
+
+	return r.queueTimeout
+}
+
+// SetDefinitionStore sets store for persistent tunnels' definitions.
+// It should be called before agents are connected.
+func (r *Registry) SetDefinitionStore(ds DefinitionStore) {
+	r.rw.Lock()
+	r.defs = ds
+	r.rw.Unlock()
+}
+
+// definitionStore returns store for persistent tunnels' definitions, or nil.
+func (r *Registry) definitionStore() DefinitionStore {
+	r.rw.RLock()
+	defer r.rw.RUnlock()
+
+	return r.defs
+}
+
+// Add registers service under its agent UUID, and attaches agent's detached tunnels to it.
+// It returns error if another service for the same agent is already registered.
+func (r *Registry) Add(s *Service) error {
+	uuid := s.UUID()
+	if uuid == "" {
+		return fmt.Errorf("agent UUID is empty")
+	}
+
+	r.rw.Lock()
+	defer r.rw.Unlock()
+
+	if r.services[uuid] != nil {
+		return fmt.Errorf("agent %q is already connected", uuid)
+	}
+	r.services[uuid] = s
+
+	if d := r.detached[uuid]; d != nil {
+		d.timer.Stop()
+		delete(r.detached, uuid)
+		for _, t := range d.tunnels {
+			s.attachTunnel(t)
+			logrus.Infof("Tunnel %s: attached to agent %q new session.", t.id, uuid)
+		}
+	}
+	return nil
+}
+
+// detach keeps tunnels of agent's ended session during grace period.
+// It returns false if tunnels should be closed immediately.
+func (r *Registry) detach(uuid string, tunnels map[string]*Tunnel) bool {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+
+	if uuid == "" || r.gracePeriod == 0 || len(tunnels) == 0 {
+		return false
+	}
+
+	d := &detached{
+		tunnels: tunnels,
+	}
+	d.timer = time.AfterFunc(r.gracePeriod, func() {
+		r.rw.Lock()
+		if r.detached[uuid] != d {
+			r.rw.Unlock()
+			return
+		}
+		delete(r.detached, uuid)
+		r.rw.Unlock()
+
+		for _, t := range d.tunnels {
+			logrus.Infof("Tunnel %s: closing, agent %q did not reconnect in %s.", t.id, uuid, r.gracePeriod)
+			t.close()
+		}
+	})
+	r.detached[uuid] = d
+	return true
+}
+
+// ForgetAgent closes and deletes detached tunnels of disconnected agent, so they do not keep their ports
+// during grace period, and are not attached to agent's new session. It returns error if agent is connected.
+func (r *Registry) ForgetAgent(uuid string) error {
+	r.rw.Lock()
+	if r.services[uuid] != nil {
+		r.rw.Unlock()
+		return fmt.Errorf("agent %q is connected", uuid)
+	}
+	d := r.detached[uuid]
+	delete(r.detached, uuid)
+	r.rw.Unlock()
+
+	if d == nil {
+		return nil
+	}
+	d.timer.Stop()
+	for _, t := range d.tunnels {
+		logrus.Infof("Tunnel %s: closing, agent %q is forgotten.", t.id, uuid)
+		t.close()
+		r.deleteDefinition(t)
+	}
+	return nil
+}
+
+// Remove unregisters service. It does nothing if other service is registered for the same agent.
+func (r *Registry) Remove(s *Service) {
+	r.rw.Lock()
+	defer r.rw.Unlock()
+
+	uuid := s.UUID()
+	if r.services[uuid] == s {
+		delete(r.services, uuid)
+	}
+}
+
+// Get returns service for given agent UUID, or nil.
+func (r *Registry) Get(uuid string) *Service {
+	r.rw.RLock()
+	defer r.rw.RUnlock()
+
+	return r.services[uuid]
+}
+
+// Services returns all registered services sorted by agent UUID.
+func (r *Registry) Services() []*Service {
+	r.rw.RLock()
+	res := make([]*Service, 0, len(r.services))
+	for _, s := range r.services {
+		res = append(res, s)
+	}
+	r.rw.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].UUID() < res[j].UUID() })
+	return res
+}
+
+// FindTunnel returns tunnel with given ID and its agent's service, or nils.
+// For detached tunnel of disconnected agent, service is nil.
+func (r *Registry) FindTunnel(id string) (*Service, *Tunnel) {
+	for _, s := range r.Services() {
+		if t := s.Tunnel(id); t != nil {
+			return s, t
+		}
+	}
+
+	r.rw.RLock()
+	defer r.rw.RUnlock()
+
+	for _, d := range r.detached {
+		if t := d.tunnels[id]; t != nil {
+			return nil, t
+		}
+	}
+	return nil, nil
+}
+
+// DetachedTunnels returns detached tunnels of disconnected agents sorted by ID.
+func (r *Registry) DetachedTunnels() []*Tunnel {
+	r.rw.RLock()
+	var res []*Tunnel
+	for _, d := range r.detached {
+		for _, t := range d.tunnels {
+			res = append(res, t)
+		}
+	}
+	r.rw.RUnlock()
+
+	sort.Slice(res, func(i, j int) bool { return res[i].id < res[j].id })
+	return res
+}
+
+// DeleteTunnel deletes tunnel with given ID, either attached to agent's session or detached.
+func (r *Registry) DeleteTunnel(id string) error {
+	s, t := r.FindTunnel(id)
+	if s != nil {
+		return s.DeleteTunnel(id)
+	}
+	if t == nil || !r.deleteDetached(t) {
+		return fmt.Errorf("no such tunnel: %s", id)
+	}
+	return nil
+}
+
+// deleteTunnel deletes given tunnel wherever it is. It does nothing if tunnel is already deleted.
+func (r *Registry) deleteTunnel(t *Tunnel) {
+	if s := t.service(); s != nil && s.DeleteTunnel(t.id) == nil {
+		return
+	}
+	r.deleteDetached(t)
+}
+
+// deleteDetached deletes given detached tunnel. It returns false if tunnel is not detached.
+func (r *Registry) deleteDetached(t *Tunnel) bool {
+	r.rw.Lock()
+	d := r.detached[t.agentUUID]
+	if d == nil || d.tunnels[t.id] != t {
+		r.rw.Unlock()
+		return false
+	}
+	delete(d.tunnels, t.id)
+	r.rw.Unlock()
+
+	logrus.Infof("Tunnel %s: closing.", t.id)
+	t.close()
+	r.deleteDefinition(t)
+	return true
+}
+
+// deleteDefinition deletes persistent tunnel's definition.
+func (r *Registry) deleteDefinition(t *Tunnel) {
+	if !t.persistent {
+		return
+	}
+	if ds := r.definitionStore(); ds != nil {
+		if err := ds.DeleteTunnel(t.id); err != nil {
+			logrus.Errorf("Tunnel %s: failed to delete definition: %s.", t.id, err)
+		}
+	}
+}
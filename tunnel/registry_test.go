@@ -0,0 +1,197 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tunnel
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Percona-Lab/pmm-api/agent"
+)
+
+// connect registers a new connected service in registry, and returns it with a function which disconnects it.
+func connect(t *testing.T, registry *Registry) (*Service, func()) {
+	t.Helper()
+
+	svc, _, closeFunc := dialPair(t, registry, Config{})
+	if err := registry.Add(svc); err != nil {
+		closeFunc()
+		t.Fatal(err)
+	}
+	return svc, func() {
+		svc.Close()
+		registry.Remove(svc)
+		closeFunc()
+	}
+}
+
+// listening returns true if tunnel accepts local connections.
+func listening(t *Tunnel) bool {
+	c, err := net.Dial("tcp", t.Listen())
+	if err != nil {
+		return false
+	}
+	c.Close()
+	return true
+}
+
+func TestRegistryGracePeriod(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		gracePeriod  time.Duration
+		queueTimeout time.Duration
+		detached     func(t *testing.T, registry *Registry, tun *Tunnel) // called while agent is disconnected
+		attached     bool                                                // tunnel is attached to agent's new session
+	}{
+		{
+			name:         "Reconnect",
+			gracePeriod:  time.Minute,
+			queueTimeout: time.Second,
+			detached:     func(t *testing.T, registry *Registry, tun *Tunnel) {},
+			attached:     true,
+		},
+		{
+			name:        "Refused",
+			gracePeriod: time.Minute,
+			detached: func(t *testing.T, registry *Registry, tun *Tunnel) {
+				// zero queue timeout refuses local connections to detached tunnel
+				c, err := net.Dial("tcp", tun.Listen())
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(5 * time.Second))
+				if b, err := ioutil.ReadAll(c); err != nil || len(b) != 0 {
+					t.Errorf("expected connection to be closed, got %q, %v", b, err)
+				}
+				waitFor(t, "tunnel error", func() bool {
+					err, _ := tun.LastError()
+					return err != nil && err.Code == agent.ErrorCode_AGENT_UNAVAILABLE
+				})
+			},
+			attached: true,
+		},
+		{
+			name:         "Deleted",
+			gracePeriod:  time.Minute,
+			queueTimeout: time.Second,
+			detached: func(t *testing.T, registry *Registry, tun *Tunnel) {
+				if err := registry.DeleteTunnel(tun.ID()); err != nil {
+					t.Fatal(err)
+				}
+			},
+		},
+		{
+			name:        "Expired",
+			gracePeriod: 50 * time.Millisecond,
+			detached: func(t *testing.T, registry *Registry, tun *Tunnel) {
+				waitFor(t, "grace period end", func() bool { return len(registry.DetachedTunnels()) == 0 })
+			},
+		},
+		{
+			name:     "ZeroGracePeriod",
+			detached: func(t *testing.T, registry *Registry, tun *Tunnel) {},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			registry := NewRegistry()
+			registry.SetGracePeriod(tc.gracePeriod, tc.queueTimeout)
+
+			svc, disconnect := connect(t, registry)
+			tun, err := svc.OpenTunnel("127.0.0.1:9100", TunnelOptions{})
+			if err != nil {
+				disconnect()
+				t.Fatal(err)
+			}
+			defer registry.DeleteTunnel(tun.ID())
+
+			disconnect()
+			if tun.AgentConnected() {
+				t.Error("tunnel is attached after disconnect")
+			}
+			if s, found := registry.FindTunnel(tun.ID()); s != nil || (found == tun) != (tc.gracePeriod != 0) {
+				t.Errorf("unexpected service %v and tunnel %v", s, found)
+			}
+			tc.detached(t, registry, tun)
+
+			svc, disconnect = connect(t, registry)
+			defer disconnect()
+			if d := registry.DetachedTunnels(); len(d) != 0 {
+				t.Errorf("unexpected detached tunnels %v", d)
+			}
+			if attached := svc.Tunnel(tun.ID()) == tun; attached != tc.attached {
+				t.Errorf("expected attached %v, got %v", tc.attached, attached)
+			}
+			if tun.AgentConnected() != tc.attached || listening(tun) != tc.attached {
+				t.Errorf("expected agent connected and listening %v, got %v and %v", tc.attached, tun.AgentConnected(), listening(tun))
+			}
+		})
+	}
+}
+
+func TestRegistryAdd(t *testing.T) {
+	registry := NewRegistry()
+	_, disconnect := connect(t, registry)
+	defer disconnect()
+
+	svc, _, closeFunc := dialPair(t, registry, Config{})
+	defer closeFunc()
+	if err := registry.Add(svc); err == nil || err.Error() != `agent "agent1" is already connected` {
+		t.Errorf("unexpected error %v", err)
+	}
+	if registry.Get("agent1") == svc {
+		t.Error("the second service is registered")
+	}
+}
+
+func TestRegistryForgetAgent(t *testing.T) {
+	registry := NewRegistry()
+	registry.SetGracePeriod(time.Minute, time.Second)
+	svc, disconnect := connect(t, registry)
+	tun, err := svc.OpenTunnel("127.0.0.1:9100", TunnelOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = registry.ForgetAgent("agent1"); err == nil || err.Error() != `agent "agent1" is connected` {
+		t.Errorf("unexpected error %v", err)
+	}
+	disconnect()
+	if d := registry.DetachedTunnels(); len(d) != 1 || d[0] != tun {
+		t.Fatalf("unexpected detached tunnels %v", d)
+	}
+
+	if err = registry.ForgetAgent("agent1"); err != nil {
+		t.Fatal(err)
+	}
+	if d := registry.DetachedTunnels(); len(d) != 0 {
+		t.Errorf("unexpected detached tunnels %v", d)
+	}
+	if c, err := net.Dial("tcp", tun.Listen()); err == nil {
+		c.Close()
+		t.Error("tunnel is still listening")
+	}
+
+	// forgotten tunnels are not attached to a new session
+	svc, disconnect = connect(t, registry)
+	defer disconnect()
+	if tt := svc.Tunnels(); len(tt) != 0 {
+		t.Errorf("unexpected tunnels %v", tt)
+	}
+}
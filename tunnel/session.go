@@ -0,0 +1,419 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tunnel
+
+// Session resumption
+//
+// Agent may request a resumable session by sending SessionHeader with NewSession value when it connects;
+// gateway responds with session ID in the same header. When connection breaks, session is suspended:
+// tunnel connections stay open, and data sent to agent is kept in per-stream replay buffers until agent
+// acknowledges it with ack frames. Agent resumes session by reconnecting with session ID in SessionHeader
+// and state of its open streams in StreamsHeader; gateway responds with its own streams state in the same header.
+// Then each side retransmits data the other side did not receive, and sets its send credit from the other side's state.
+// Streams unknown to the other side are aborted. Agents using legacy protocol (see legacy.go) can't resume sessions.
+//
+// Stream state is "streamID:received:granted". Received is the number of data bytes received from the other side,
+// plus 1 after close write (like TCP sequence numbers); ack frames carry the same value. Granted is the total number
+// of bytes the other side may send: initial window plus all window updates.
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Percona-Lab/pmm-api/agent"
+	"github.com/Percona-Lab/wsrpc"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SessionHeader contains session ID, see package documentation.
+	SessionHeader = "Pmm-Session-Id"
+
+	// StreamsHeader contains state of open data streams on session resume.
+	StreamsHeader = "Pmm-Session-Streams"
+
+	// NewSession is a SessionHeader value used by agent to request a new resumable session.
+	NewSession = "new"
+
+	// maxReplayWindows is the maximal size of stream's replay buffer in windows; streams with more
+	// unacknowledged data can't be resumed.
+	maxReplayWindows = 4
+)
+
+// session states
+const (
+	sessionActive = iota
+	sessionSuspended
+	sessionEnded
+)
+
+// NewSessionID returns a new random session ID.
+func NewSessionID() string {
+	return newID() + newID()
+}
+
+// streamState is the state of data stream reported by the other side on session resume.
+type streamState struct {
+	received uint64
+	granted  uint64
+}
+
+// parseStreams parses StreamsHeader value.
+func parseStreams(s string) (map[uint64]streamState, error) {
+	res := make(map[uint64]streamState)
+	if s == "" {
+		return res, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.Split(strings.TrimSpace(part), ":")
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid stream state %q", part)
+		}
+		var values [3]uint64
+		for i, f := range fields {
+			v, err := strconv.ParseUint(f, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid stream state %q", part)
+			}
+			values[i] = v
+		}
+		res[values[0]] = streamState{
+			received: values[1],
+			granted:  values[2],
+		}
+	}
+	return res, nil
+}
+
+// SessionID returns resumable session ID, or empty string if session is not resumable.
+func (s *Service) SessionID() string {
+	return s.config.SessionID
+}
+
+// Suspended returns true if agent's connection broke, and session is waiting for resume.
+func (s *Service) Suspended() bool {
+	s.sessM.Lock()
+	defer s.sessM.Unlock()
+
+	return s.sessState == sessionSuspended
+}
+
+// Suspend should be called when agent's connection broke. It waits up to timeout for agent to resume session,
+// and returns new agent's connection. It returns nil if session is not resumable, was kicked or evicted, or was not resumed.
+func (s *Service) Suspend(timeout time.Duration) *wsrpc.Conn {
+	if s.config.SessionID == "" || s.Kicked() || s.Evicted() || timeout <= 0 {
+		return nil
+	}
+
+	s.sessM.Lock()
+	if s.sessState != sessionActive {
+		s.sessM.Unlock()
+		return nil
+	}
+	s.sessState = sessionSuspended
+	ch := make(chan *wsrpc.Conn, 1)
+	s.resumeCh = ch
+	s.sessM.Unlock()
+
+	logrus.Infof("Agent %q session %s suspended, waiting %s for resume.", s.UUID(), s.config.SessionID, timeout)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case conn := <-ch:
+		return conn
+	case <-timer.C:
+	}
+
+	s.sessM.Lock()
+	defer s.sessM.Unlock()
+
+	if s.sessState == sessionSuspended {
+		logrus.Warnf("Agent %q session %s was not resumed in %s.", s.UUID(), s.config.SessionID, timeout)
+		s.sessState = sessionEnded
+		return nil
+	}
+	return <-ch // resumed or abandoned concurrently
+}
+
+// Abandon ends suspended session without waiting for resume. It does nothing if session is not suspended.
+func (s *Service) Abandon() {
+	s.sessM.Lock()
+	defer s.sessM.Unlock()
+
+	if s.sessState == sessionSuspended {
+		s.sessState = sessionEnded
+		s.resumeCh <- nil
+	}
+}
+
+// Resume resumes suspended session with agent's streams state from StreamsHeader value.
+// Upgrade is called with response headers to establish agent's new connection.
+// If session is still active (for example, gateway did not notice that connection broke yet),
+// its connection is closed, and error is returned, so agent should retry.
+func (s *Service) Resume(streams string, upgrade func(http.Header) (*wsrpc.Conn, error)) error {
+	peer, err := parseStreams(streams)
+	if err != nil {
+		return err
+	}
+
+	s.sessM.Lock()
+	defer s.sessM.Unlock()
+
+	switch s.sessState {
+	case sessionActive:
+		go s.getConn().Close()
+		return fmt.Errorf("agent %q session %s is still active, closing its connection", s.UUID(), s.config.SessionID)
+	case sessionEnded:
+		return fmt.Errorf("agent %q session %s is ended", s.UUID(), s.config.SessionID)
+	}
+
+	// block writers of all streams until data is retransmitted
+	s.rw.RLock()
+	conns := make([]*localConn, 0, len(s.streams))
+	for _, c := range s.streams {
+		conns = append(conns, c)
+	}
+	s.rw.RUnlock()
+	for _, c := range conns {
+		c.sendM.Lock()
+	}
+	defer func() {
+		for _, c := range conns {
+			c.sendM.Unlock()
+		}
+	}()
+
+	states := make([]string, 0, len(conns))
+	for _, c := range conns {
+		if _, ok := peer[c.streamID]; ok {
+			states = append(states, fmt.Sprintf("%d:%d:%d", c.streamID, atomic.LoadUint64(&c.received), c.granted))
+		}
+	}
+	h := make(http.Header)
+	h.Set(StreamsHeader, strings.Join(states, ","))
+	conn, err := upgrade(h)
+	if err != nil {
+		return err
+	}
+
+	s.setupConn(conn)
+	s.rw.Lock()
+	s.conn = conn
+	s.client = agent.NewServiceClient(conn)
+	close(s.resumed)
+	s.resumed = make(chan struct{})
+	s.rw.Unlock()
+
+	for _, c := range conns {
+		p, ok := peer[c.streamID]
+		if !ok {
+			err = fmt.Errorf("stream is unknown to agent")
+		} else {
+			err = c.resume(conn, p)
+		}
+		if err != nil {
+			logrus.Warnf("Tunnel %s: stream %d can't be resumed: %s.", c.id, c.streamID, err)
+			go c.abort()
+		}
+	}
+
+	s.sessState = sessionActive
+	s.resumeCh <- conn
+	return nil
+}
+
+// retryAfterResume returns true if agent's call for local connection's stream failed because connection broke,
+// and session was resumed after that (resumed is the channel obtained before the call). It blocks until session
+// is resumed or ended, or ctx is done. Stream is unregistered before waiting, so it is not resumed; a new one should be used.
+func (s *Service) retryAfterResume(ctx context.Context, c *localConn, err error, resumed <-chan struct{}) bool {
+	if err == nil || s.config.SessionID == "" {
+		return false
+	}
+	switch errors.Cause(err) {
+	case context.DeadlineExceeded, context.Canceled:
+		return false
+	}
+
+	s.rw.Lock()
+	delete(s.streams, c.streamID)
+	s.rw.Unlock()
+
+	select {
+	case <-resumed:
+		return true
+	case <-s.ctx.Done():
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// resume retransmits data not received by agent, and sets send credit from agent's stream state.
+// Caller should hold sendM lock.
+func (c *localConn) resume(conn *wsrpc.Conn, p streamState) error {
+	c.replayM.Lock()
+	defer c.replayM.Unlock()
+
+	max := c.sent
+	if c.closeWriteSent {
+		max++
+	}
+	switch {
+	case c.replayOverflow:
+		return fmt.Errorf("replay buffer overflow")
+	case p.received < c.acked || p.received > max:
+		return fmt.Errorf("agent received %d bytes, but %d were acknowledged and %d were sent", p.received, c.acked, c.sent)
+	}
+	c.ack(p.received)
+	logrus.Debugf("Tunnel %s: resuming stream %d, retransmitting %d bytes.", c.id, c.streamID, len(c.replay))
+
+	for b := c.replay; len(b) > 0; {
+		n := len(b)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		if err := conn.WriteFrameWeight(&wsrpc.Frame{
+			StreamID: c.streamID,
+			Type:     wsrpc.FrameData,
+			Data:     b[:n],
+		}, c.weight); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	if c.closeWriteSent && p.received <= c.sent {
+		if err := conn.WriteFrameWeight(&wsrpc.Frame{
+			StreamID: c.streamID,
+			Type:     wsrpc.FrameCloseWrite,
+		}, c.weight); err != nil {
+			return err
+		}
+	}
+
+	c.send.reset(int64(p.granted) - int64(c.sendCut) - int64(c.sent))
+	return nil
+}
+
+// ack drops data acknowledged by agent from replay buffer. Caller should hold replayM lock.
+func (c *localConn) ack(received uint64) {
+	if received > c.sent {
+		received = c.sent // close write
+	}
+	if received <= c.acked {
+		return
+	}
+	n := received - c.acked
+	c.acked = received
+	if c.replay != nil {
+		// copy, so frames retransmitted from the old buffer are not affected
+		c.replay = append(make([]byte, 0, len(c.replay)-int(n)), c.replay[n:]...)
+	}
+}
+
+// keep stores data sent to agent in replay buffer, if session is resumable.
+func (s *Service) keep(c *localConn, b []byte) {
+	c.replayM.Lock()
+	defer c.replayM.Unlock()
+
+	c.sent += uint64(len(b))
+	if s.config.SessionID == "" || c.replayOverflow {
+		return
+	}
+	if len(c.replay)+len(b) > maxReplayWindows*c.window {
+		logrus.Warnf("Tunnel %s: replay buffer overflow, %d bytes are not acknowledged by agent.", c.id, len(c.replay)+len(b))
+		c.replayOverflow = true
+		c.replay = nil
+		return
+	}
+	c.replay = append(c.replay, b...)
+}
+
+// writeData consumes send credit and sends data to agent.
+func (s *Service) writeData(c *localConn, b []byte) error {
+	c.sendM.Lock()
+	defer c.sendM.Unlock()
+
+	c.send.consume(len(b))
+	s.keep(c, b)
+	err := s.getConn().WriteFrameWeight(&wsrpc.Frame{
+		StreamID: c.streamID,
+		Type:     wsrpc.FrameData,
+		Data:     b,
+	}, c.weight)
+	return s.writeError(err)
+}
+
+// writeCloseWrite tells agent that local client finished writing.
+func (s *Service) writeCloseWrite(c *localConn) error {
+	c.sendM.Lock()
+	defer c.sendM.Unlock()
+
+	c.replayM.Lock()
+	c.closeWriteSent = true
+	c.replayM.Unlock()
+	err := s.getConn().WriteFrameWeight(&wsrpc.Frame{
+		StreamID: c.streamID,
+		Type:     wsrpc.FrameCloseWrite,
+	}, c.weight)
+	return s.writeError(err)
+}
+
+// writeWindowUpdate replenishes agent's send credit.
+func (s *Service) writeWindowUpdate(c *localConn, increment int) error {
+	c.sendM.Lock()
+	defer c.sendM.Unlock()
+
+	c.granted += uint64(increment)
+	err := s.getConn().WriteFrame(&wsrpc.Frame{
+		StreamID:  c.streamID,
+		Type:      wsrpc.FrameWindowUpdate,
+		Increment: uint32(increment),
+	})
+	return s.writeError(err)
+}
+
+// writeError returns nil for resumable session: data will be retransmitted, and window will be restored on resume.
+func (s *Service) writeError(err error) error {
+	if s.config.SessionID != "" {
+		return nil
+	}
+	return err
+}
+
+// onReceived updates the number of bytes received from agent, and acknowledges them if needed.
+// It is called from connection's reading goroutine.
+func (s *Service) onReceived(c *localConn, n uint64, closeWrite bool) {
+	received := atomic.AddUint64(&c.received, n)
+	// acks are sent as often as window updates
+	if s.config.SessionID == "" || (received-c.ackSent < uint64(windowUpdateThreshold(c.window)) && !closeWrite) {
+		return
+	}
+	c.ackSent = received
+	if err := s.getConn().WriteFrame(&wsrpc.Frame{
+		StreamID: c.streamID,
+		Type:     wsrpc.FrameAck,
+		Ack:      received,
+	}); err != nil {
+		logrus.Debugf("Stream %d: failed to send ack: %s.", c.streamID, err)
+	}
+}
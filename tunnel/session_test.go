@@ -0,0 +1,327 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tunnel
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Percona-Lab/wsrpc"
+
+	"github.com/Percona-Lab/pmm-gateway/auth"
+)
+
+func TestParseStreams(t *testing.T) {
+	for _, tc := range []struct {
+		s        string
+		expected map[uint64]streamState
+		err      bool
+	}{
+		{s: "", expected: map[uint64]streamState{}},
+		{s: "1:10:20", expected: map[uint64]streamState{1: {received: 10, granted: 20}}},
+		{s: "1:10:20, 3:0:5", expected: map[uint64]streamState{
+			1: {received: 10, granted: 20},
+			3: {received: 0, granted: 5},
+		}},
+		{s: "1:10", err: true},
+		{s: "1:10:20:30", err: true},
+		{s: "1:x:20", err: true},
+		{s: "1:-1:20", err: true},
+		{s: "1:10:20,", err: true},
+	} {
+		t.Run(tc.s, func(t *testing.T) {
+			actual, err := parseStreams(tc.s)
+			if tc.err {
+				if err == nil {
+					t.Fatalf("expected error, got %v", actual)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(tc.expected, actual) {
+				t.Errorf("expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+// credit returns send credit of local connection.
+func credit(c *localConn) int64 {
+	c.send.m.Lock()
+	defer c.send.m.Unlock()
+
+	return c.send.credit
+}
+
+func TestLocalConnAck(t *testing.T) {
+	s := &Service{config: Config{SessionID: "session"}}
+	c := newLocalConn(1, nil, 1, 16)
+	s.keep(c, []byte("0123"))
+	s.keep(c, []byte("456789"))
+	if c.sent != 10 || string(c.replay) != "0123456789" {
+		t.Fatalf("unexpected state: sent %d, replay %q", c.sent, c.replay)
+	}
+
+	replay := c.replay
+	c.ack(4)
+	if c.acked != 4 || string(c.replay) != "456789" {
+		t.Errorf("unexpected state: acked %d, replay %q", c.acked, c.replay)
+	}
+	if string(replay) != "0123456789" {
+		t.Errorf("old replay buffer is modified: %q", replay)
+	}
+
+	// old acks are ignored
+	c.ack(2)
+	if c.acked != 4 || string(c.replay) != "456789" {
+		t.Errorf("unexpected state: acked %d, replay %q", c.acked, c.replay)
+	}
+
+	// close write counts as 1 byte, but it is not in replay buffer
+	c.ack(11)
+	if c.acked != 10 || len(c.replay) != 0 {
+		t.Errorf("unexpected state: acked %d, replay %q", c.acked, c.replay)
+	}
+}
+
+func TestLocalConnKeep(t *testing.T) {
+	t.Run("NotResumable", func(t *testing.T) {
+		s := &Service{}
+		c := newLocalConn(1, nil, 1, 16)
+		s.keep(c, []byte("0123456789"))
+		if c.sent != 10 || c.replay != nil {
+			t.Errorf("unexpected state: sent %d, replay %q", c.sent, c.replay)
+		}
+	})
+
+	t.Run("Overflow", func(t *testing.T) {
+		const window = 16
+		s := &Service{config: Config{SessionID: "session"}}
+		c := newLocalConn(1, nil, 1, window)
+		s.keep(c, make([]byte, maxReplayWindows*window))
+		if c.replayOverflow {
+			t.Fatal("unexpected overflow")
+		}
+		s.keep(c, []byte("x"))
+		if !c.replayOverflow || c.replay != nil || c.sent != maxReplayWindows*window+1 {
+			t.Fatalf("unexpected state: overflow %t, sent %d, replay %d bytes", c.replayOverflow, c.sent, len(c.replay))
+		}
+
+		// acks do not help
+		c.ack(c.sent)
+		s.keep(c, []byte("x"))
+		if !c.replayOverflow || c.replay != nil {
+			t.Fatalf("unexpected state: overflow %t, replay %d bytes", c.replayOverflow, len(c.replay))
+		}
+		if err := c.resume(nil, streamState{received: c.sent, granted: c.sent}); err == nil || err.Error() != "replay buffer overflow" {
+			t.Errorf("unexpected error %v", err)
+		}
+	})
+}
+
+func TestLocalConnResume(t *testing.T) {
+	s := &Service{config: Config{SessionID: "session"}}
+	newConn := func(closeWrite bool) *localConn {
+		c := newLocalConn(1, nil, 1, 16)
+		s.keep(c, []byte("0123456789"))
+		c.ack(4)
+		c.closeWriteSent = closeWrite
+		return c
+	}
+
+	for _, tc := range []struct {
+		name       string
+		closeWrite bool
+		received   uint64
+	}{
+		{"BeforeAcked", false, 3},
+		{"AfterSent", false, 11},
+		{"AfterCloseWrite", true, 12},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newConn(tc.closeWrite)
+			if err := c.resume(nil, streamState{received: tc.received, granted: 16}); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+
+	// agent received everything including close write, so nothing is retransmitted
+	t.Run("CloseWriteReceived", func(t *testing.T) {
+		c := newConn(true)
+		if err := c.resume(nil, streamState{received: 11, granted: 20}); err != nil {
+			t.Fatal(err)
+		}
+		if c.acked != 10 || len(c.replay) != 0 {
+			t.Errorf("unexpected state: acked %d, replay %q", c.acked, c.replay)
+		}
+		if cr := credit(c); cr != 10 {
+			t.Errorf("expected credit 10, got %d", cr)
+		}
+	})
+}
+
+func TestSuspendResume(t *testing.T) {
+	const (
+		sessionID = "session"
+		window    = 64
+	)
+
+	svcCh := make(chan *Service, 1)
+	gwConns := make(chan *wsrpc.Conn, 1)
+	resumeErrs := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Header.Get(StreamsHeader) == "" {
+			conn, err := wsrpc.Upgrade(rw, req, nil)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			gwConns <- conn
+			return
+		}
+
+		svc := <-svcCh
+		resumeErrs <- svc.Resume(req.Header.Get(StreamsHeader), func(h http.Header) (*wsrpc.Conn, error) {
+			return wsrpc.Upgrade(rw, req, h)
+		})
+	}))
+	defer server.Close()
+	addr := "ws" + strings.TrimPrefix(server.URL, "http")
+
+	agentFrames := make(chan *wsrpc.Frame, 10)
+	nextFrame := func() *wsrpc.Frame {
+		t.Helper()
+		select {
+		case f := <-agentFrames:
+			return f
+		case <-time.After(5 * time.Second):
+			t.Fatal("no frame received by agent")
+			return nil
+		}
+	}
+
+	agentConn, _, err := wsrpc.Dial(addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentConn.SetFrameHandler(func(f *wsrpc.Frame) { agentFrames <- f })
+	svc := NewService(&auth.Identity{AgentUUID: "agent1"}, "test", <-gwConns, nil, Config{
+		SessionID: sessionID,
+		Window:    window,
+	})
+	defer func() { svc.getConn().Close() }()
+
+	// stream 1 is known to agent, stream 2 is not
+	conns := make([]*localConn, 2)
+	for i := range conns {
+		local, remote := net.Pipe()
+		defer remote.Close()
+		conns[i] = newLocalConn(uint64(i+1), local, 1, window)
+		conns[i].id = "tunnel" + strconv.Itoa(i+1)
+		conns[i].send.add(window)
+		svc.rw.Lock()
+		svc.streams[conns[i].streamID] = conns[i]
+		svc.rw.Unlock()
+	}
+	c := conns[0]
+
+	// exchange some data, agent acknowledges a part of it
+	if err = svc.writeData(c, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if f := nextFrame(); f.Type != wsrpc.FrameData || string(f.Data) != "hello" {
+		t.Fatalf("unexpected frame %v", f)
+	}
+	for _, f := range []*wsrpc.Frame{
+		{StreamID: 1, Type: wsrpc.FrameAck, Ack: 2},
+		{StreamID: 1, Type: wsrpc.FrameData, Data: []byte("abc")},
+	} {
+		if err = agentConn.WriteFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "ack and data", func() bool {
+		c.replayM.Lock()
+		defer c.replayM.Unlock()
+		return c.acked == 2 && atomic.LoadUint64(&c.received) == 3
+	})
+	if string(c.replay) != "llo" {
+		t.Fatalf("unexpected replay buffer %q", c.replay)
+	}
+
+	// connection breaks, data sent while session is suspended is kept for retransmission
+	agentConn.Close()
+	resumed := make(chan *wsrpc.Conn, 1)
+	go func() { resumed <- svc.Suspend(5 * time.Second) }()
+	waitFor(t, "suspend", svc.Suspended)
+	if err = svc.writeData(c, []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if err = svc.writeCloseWrite(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// agent received "hell", and granted 16 more bytes to gateway
+	svcCh <- svc
+	h := make(http.Header)
+	h.Set(SessionHeader, sessionID)
+	h.Set(StreamsHeader, "1:4:80")
+	agentConn, rh, err := wsrpc.Dial(addr, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer agentConn.Close()
+	agentConn.SetFrameHandler(func(f *wsrpc.Frame) { agentFrames <- f })
+	if err = <-resumeErrs; err != nil {
+		t.Fatal(err)
+	}
+	if s := rh.Get(StreamsHeader); s != "1:3:64" {
+		t.Errorf("unexpected gateway streams state %q", s)
+	}
+	select {
+	case conn := <-resumed:
+		if conn == nil || conn != svc.getConn() {
+			t.Fatalf("unexpected connection %v", conn)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session was not resumed")
+	}
+
+	if f := nextFrame(); f.Type != wsrpc.FrameData || string(f.Data) != "oworld" {
+		t.Errorf("unexpected frame %v", f)
+	}
+	if f := nextFrame(); f.Type != wsrpc.FrameCloseWrite || f.StreamID != 1 {
+		t.Errorf("unexpected frame %v", f)
+	}
+	if cr := credit(c); cr != 80-10 {
+		t.Errorf("expected credit %d, got %d", 80-10, cr)
+	}
+	if c.isAborted() {
+		t.Error("stream 1 is aborted")
+	}
+	waitFor(t, "stream 2 abort", conns[1].isAborted)
+}
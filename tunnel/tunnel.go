@@ -17,114 +17,846 @@
 package tunnel
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Percona-Lab/pmm-api/agent"
 	"github.com/Percona-Lab/pmm-api/gateway"
+	"github.com/Percona-Lab/wsrpc"
 	"github.com/sirupsen/logrus"
+
+	"github.com/Percona-Lab/pmm-gateway/auth"
+	"github.com/Percona-Lab/pmm-gateway/ports"
 )
 
+const (
+	// chunkSize is the maximal size of data sent to agent in a single data frame.
+	chunkSize = 16 * 1024
+
+	// DefaultCoalesceDelay is the default value of Config.CoalesceDelay.
+	DefaultCoalesceDelay = time.Millisecond
+
+	// DefaultRPCTimeout is the default timeout of agent's RPC methods.
+	DefaultRPCTimeout = 30 * time.Second
+
+	// idle HTTP connections via agent kept for reuse, see Service.Transport
+	maxIdleHTTPConns    = 4
+	idleHTTPConnTimeout = 90 * time.Second
+)
+
+// Config contains agent session settings.
+type Config struct {
+	// Hostname is the hostname reported by agent; it may be empty.
+	Hostname string
+
+	// Labels are labels reported by agent; they may be nil.
+	Labels map[string]string
+
+	// CoalesceDelay is the maximal time to wait for more local data before sending a chunk to agent.
+	// Zero disables coalescing.
+	CoalesceDelay time.Duration
+
+	// RPCTimeouts contains timeouts of agent's RPC methods by method name, like "CreateTunnel".
+	// DefaultRPCTimeout is used for other methods.
+	RPCTimeouts map[string]time.Duration
+
+	// Ports allocates stable tunnel listen ports. If nil, random ports are used.
+	Ports *ports.Allocator
+
+	// SessionID is the resumable session ID, see NewSessionID. If empty, session is not resumable.
+	SessionID string
+
+	// Legacy is true for agents using legacy protocol without data stream frames, see legacy.go.
+	Legacy bool
+
+	// PingInterval is the interval of pings sent to agent. Zero means wsrpc default.
+	PingInterval time.Duration
+
+	// Window is the maximal amount of data in flight per tunnel connection in each direction:
+	// the receive window advertised to agent, and the limit of data sent to agent but not consumed yet.
+	// Zero means DefaultWindow.
+	Window int
+
+	// MaxMissedPongs is the number of agent's missed pongs after which session is evicted, see Service.Evicted.
+	// Zero disables eviction.
+	MaxMissedPongs int
+}
+
+// rpcTimeout returns timeout for agent's RPC method.
+func (c *Config) rpcTimeout(method string) time.Duration {
+	if t := c.RPCTimeouts[method]; t > 0 {
+		return t
+	}
+	return DefaultRPCTimeout
+}
+
+// window returns tunnel connection window.
+func (c *Config) window() int {
+	if c.Window > 0 {
+		return c.Window
+	}
+	return DefaultWindow
+}
+
+// Service handles a single agent session: it serves gateway requests from that agent
+// and manages tunnels via that agent. Tunnel connections data is carried by data stream frames,
+// unary RPCs are used only for control operations.
 type Service struct {
-	client agent.ServiceClient
+	identity    *auth.Identity
+	remoteAddr  string
+	connectedAt time.Time
+	conn        *wsrpc.Conn
+	client      agent.ServiceClient
+	registry    *Registry
+	config      Config
+	ctx         context.Context // canceled when session ends
+	cancel      context.CancelFunc
+	transport   *http.Transport
+
+	lastStreamID uint64 // atomic
+	kicked       int32  // atomic, 1 if session was closed by Kick
+	stats        streamStats
+
+	sessM     sync.Mutex
+	sessState int              // sessionActive, sessionSuspended, or sessionEnded
+	resumeCh  chan *wsrpc.Conn // receives agent's new connection or nil, see Suspend
 
 	rw      sync.RWMutex
-	tunnels map[string]net.Conn
+	resumed chan struct{} // closed and replaced when session is resumed on a new connection
+	// closed and replaced when local connection is registered, see legacyConn
+	connRegistered chan struct{}
+	conns          map[string]*localConn // agent's tunnel ID -> local connection
+	streams        map[uint64]*localConn // data stream ID -> local connection
+	tunnels        map[string]*Tunnel    // tunnel ID -> tunnel
+	closed         bool
 }
 
-func NewService(client agent.ServiceClient) *Service {
-	return &Service{
-		client:  client,
-		tunnels: make(map[string]net.Conn),
+// NewService creates a new service for authenticated agent (its UUID may be empty) connected from remoteAddr
+// via given connection. Requests for other agents are routed via registry.
+func NewService(identity *auth.Identity, remoteAddr string, conn *wsrpc.Conn, registry *Registry, config Config) *Service {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &Service{
+		identity:       identity,
+		remoteAddr:     remoteAddr,
+		connectedAt:    time.Now(),
+		conn:           conn,
+		client:         agent.NewServiceClient(conn),
+		registry:       registry,
+		config:         config,
+		ctx:            ctx,
+		cancel:         cancel,
+		resumed:        make(chan struct{}),
+		connRegistered: make(chan struct{}),
+		conns:          make(map[string]*localConn),
+		streams:        make(map[uint64]*localConn),
+		tunnels:        make(map[string]*Tunnel),
 	}
+	s.transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return s.DialContext(ctx, addr)
+		},
+		MaxIdleConnsPerHost: maxIdleHTTPConns,
+		IdleConnTimeout:     idleHTTPConnTimeout,
+	}
+	s.setupConn(conn)
+	return s
 }
 
-func (s *Service) runTunnel(c net.Conn, dial string) {
-	defer c.Close()
+// setupConn prepares agent's new connection for session.
+func (s *Service) setupConn(conn *wsrpc.Conn) {
+	conn.SetFrameHandler(s.handleFrame)
+	conn.SetObserver(connObserver{})
+	if s.config.PingInterval > 0 {
+		conn.SetPingInterval(s.config.PingInterval)
+	}
+	conn.SetMaxMissedPongs(s.config.MaxMissedPongs)
+}
 
-	res, err := s.client.CreateTunnel(&agent.CreateTunnelRequest{
-		Dial: dial,
-	})
+// getConn returns agent's current connection.
+func (s *Service) getConn() *wsrpc.Conn {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+
+	return s.conn
+}
+
+// getClient returns agent's RPC client for current connection.
+func (s *Service) getClient() agent.ServiceClient {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+
+	return s.client
+}
+
+// UUID returns agent UUID.
+func (s *Service) UUID() string {
+	return s.identity.AgentUUID
+}
+
+// Identity returns authenticated agent identity.
+func (s *Service) Identity() *auth.Identity {
+	return s.identity
+}
+
+// Hostname returns the hostname reported by agent, or empty string.
+func (s *Service) Hostname() string {
+	return s.config.Hostname
+}
+
+// Labels returns labels reported by agent. They should not be modified.
+func (s *Service) Labels() map[string]string {
+	return s.config.Labels
+}
+
+// RemoteAddr returns agent's remote address.
+func (s *Service) RemoteAddr() string {
+	return s.remoteAddr
+}
+
+// ConnectedAt returns agent's connection time.
+func (s *Service) ConnectedAt() time.Time {
+	return s.connectedAt
+}
+
+// Latency returns the last measured agent's connection round-trip time.
+func (s *Service) Latency() time.Duration {
+	return s.getConn().Latency()
+}
+
+// Ping checks agent's connection and returns round-trip time.
+func (s *Service) Ping(timeout time.Duration) (time.Duration, error) {
+	return s.getConn().Ping(timeout)
+}
+
+// Kick closes agent's connection and ends session, even if it is resumable.
+func (s *Service) Kick() error {
+	atomic.StoreInt32(&s.kicked, 1)
+	s.Abandon()
+	return s.getConn().Close()
+}
+
+// Kicked returns true if session was closed by Kick.
+func (s *Service) Kicked() bool {
+	return atomic.LoadInt32(&s.kicked) == 1
+}
+
+// TunnelOptions contains optional tunnel parameters.
+type TunnelOptions struct {
+	// TTL is the time after which tunnel is deleted automatically; zero means never.
+	TTL time.Duration
+
+	// Weight is the tunnel's share of agent's connection relative to other tunnels; zero means 1.
+	Weight int
+
+	// ServiceType is the type of service behind tunnel, like "node_exporter"; it may be empty.
+	ServiceType string
+
+	// Persistent tunnel's definition is saved to registry's definition store (if set),
+	// and tunnel is restored by RestoreTunnels when agent reconnects, until it is deleted or expires.
+	Persistent bool
+}
+
+// OpenTunnel creates a new tunnel via this agent to given address.
+func (s *Service) OpenTunnel(dial string, opts TunnelOptions) (*Tunnel, error) {
+	def := &Definition{
+		ID:          newID(),
+		AgentUUID:   s.UUID(),
+		Dial:        dial,
+		Weight:      opts.Weight,
+		ServiceType: opts.ServiceType,
+		CreatedAt:   time.Now(),
+	}
+	if opts.TTL != 0 {
+		def.ExpiresAt = def.CreatedAt.Add(opts.TTL)
+	}
+
+	t, err := s.openTunnel(def, opts.Persistent)
 	if err != nil {
-		logrus.Error(err)
-		return
+		return nil, err
+	}
+	if opts.Persistent {
+		if ds := s.registry.definitionStore(); ds != nil {
+			if err = ds.SaveTunnel(def); err != nil {
+				logrus.Errorf("Tunnel %s: failed to save definition: %s.", t.id, err)
+			}
+		}
 	}
+	return t, nil
+}
 
-	tunnelID := res.TunnelId
+// openTunnel creates a new tunnel from definition.
+// There may be only one tunnel to the same dial address via the same agent.
+func (s *Service) openTunnel(def *Definition, persistent bool) (*Tunnel, error) {
+	s.rw.RLock()
+	err := s.checkDial(def.Dial)
+	s.rw.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	var l net.Listener
+	if s.config.Ports != nil {
+		l, err = s.config.Ports.Listen(s.UUID(), def.Dial)
+	} else {
+		l, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		return nil, err
+	}
 
+	t := &Tunnel{
+		id:          def.ID,
+		agentUUID:   s.UUID(),
+		dial:        def.Dial,
+		weight:      def.Weight,
+		serviceType: def.ServiceType,
+		persistent:  persistent,
+		createdAt:   def.CreatedAt,
+		expiresAt:   def.ExpiresAt,
+		l:           l,
+		attached:    make(chan struct{}),
+		conns:       make(map[string]*localConn),
+		errors:      make(map[agent.ErrorCode]int),
+	}
+	if t.weight <= 0 {
+		t.weight = 1
+	}
+	if !t.expiresAt.IsZero() {
+		t.ttlTimer = time.AfterFunc(time.Until(t.expiresAt), func() {
+			logrus.Infof("Tunnel %s: TTL expired.", t.id)
+			s.registry.deleteTunnel(t)
+		})
+	}
+
+	s.rw.Lock()
+	if s.closed {
+		s.rw.Unlock()
+		t.close()
+		return nil, fmt.Errorf("agent %q session is closed", s.UUID())
+	}
+	if s.tunnels[t.id] != nil {
+		s.rw.Unlock()
+		t.close()
+		return nil, fmt.Errorf("tunnel %s already exists", t.id)
+	}
+	if err = s.checkDial(t.dial); err != nil {
+		s.rw.Unlock()
+		t.close()
+		return nil, err
+	}
+	s.tunnels[t.id] = t
+	t.attach(s)
+	s.rw.Unlock()
+
+	logrus.Infof("Tunnel %s: listening on %s, dialing %s via agent %q.", t.id, t.Listen(), t.dial, s.UUID())
+	go s.registry.runListener(t)
+	return t, nil
+}
+
+// checkDial returns error if tunnel to given dial address already exists. Caller must hold lock.
+func (s *Service) checkDial(dial string) error {
+	for _, t := range s.tunnels {
+		if t.dial == dial {
+			return fmt.Errorf("tunnel to %s via agent %q already exists on %s", dial, s.UUID(), t.Listen())
+		}
+	}
+	return nil
+}
+
+// attachTunnel adds detached tunnel to this session.
+func (s *Service) attachTunnel(t *Tunnel) {
 	s.rw.Lock()
-	s.tunnels[tunnelID] = c
+	s.tunnels[t.id] = t
+	t.attach(s)
 	s.rw.Unlock()
+}
+
+// Dial connects to given address via agent. Returned connection does not belong to any tunnel.
+func (s *Service) Dial(dial string) (net.Conn, error) {
+	return s.DialContext(context.Background(), dial)
+}
+
+// DialContext is like Dial, but stops waiting for agent when ctx is done.
+func (s *Service) DialContext(ctx context.Context, dial string) (net.Conn, error) {
+	local, remote := net.Pipe()
+	c, err := s.openConn(ctx, dial, remote, 1)
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+
+	go func() {
+		defer s.closeConn(c)
+		s.forward(c)
+	}()
+	return local, nil
+}
+
+// Transport returns HTTP transport making requests via agent.
+// Connections are kept alive and reused for requests to the same address.
+func (s *Service) Transport() http.RoundTripper {
+	return s.transport
+}
+
+// Close cancels pending agent's RPCs, closes all connections and prevents creation of new tunnels.
+// Tunnels are detached and kept by registry during grace period, or closed if it is zero or session was evicted.
+// It should be called when agent session ends, before service is removed from registry.
+func (s *Service) Close() {
+	s.cancel()
+	s.transport.CloseIdleConnections()
+
+	s.rw.Lock()
+	s.closed = true
+	tunnels := s.tunnels
+	s.tunnels = make(map[string]*Tunnel)
+	conns := make([]*localConn, 0, len(s.streams))
+	for _, c := range s.streams {
+		conns = append(conns, c)
+	}
+	s.rw.Unlock()
+
+	for _, t := range tunnels {
+		t.detach()
+	}
+	// evicted agent is not expected to reconnect soon
+	if !s.Evicted() && s.registry.detach(s.UUID(), tunnels) {
+		for _, t := range tunnels {
+			logrus.Infof("Tunnel %s: detached, agent %q session ended.", t.id, s.UUID())
+		}
+	} else {
+		for _, t := range tunnels {
+			logrus.Infof("Tunnel %s: closing, agent %q session ended.", t.id, s.UUID())
+			t.close()
+		}
+	}
+
+	// close tunnel connections and connections made by Dial
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// DeleteTunnel closes tunnel's listener and all its connections.
+// Persistent tunnel's definition is deleted too.
+func (s *Service) DeleteTunnel(id string) error {
+	s.rw.Lock()
+	t := s.tunnels[id]
+	delete(s.tunnels, id)
+	s.rw.Unlock()
+
+	if t == nil {
+		return fmt.Errorf("no such tunnel: %s", id)
+	}
+	logrus.Infof("Tunnel %s: closing.", id)
+	t.close()
+	s.registry.deleteDefinition(t)
+	return nil
+}
+
+// Tunnel returns tunnel by ID, or nil.
+func (s *Service) Tunnel(id string) *Tunnel {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+
+	return s.tunnels[id]
+}
+
+// Tunnels returns all tunnels sorted by ID.
+func (s *Service) Tunnels() []*Tunnel {
+	s.rw.RLock()
+	res := make([]*Tunnel, 0, len(s.tunnels))
+	for _, t := range s.tunnels {
+		res = append(res, t)
+	}
+	s.rw.RUnlock()
 
+	sort.Slice(res, func(i, j int) bool { return res[i].id < res[j].id })
+	return res
+}
+
+// runListener accepts tunnel's local connections until tunnel is closed.
+func (r *Registry) runListener(t *Tunnel) {
+	var delay time.Duration
 	for {
-		b := make([]byte, 4096)
-		n, err := c.Read(b)
+		c, err := t.l.Accept()
 		if err != nil {
-			logrus.Error(err)
+			if t.isClosed() {
+				return
+			}
+
+			// back off on temporary errors like EMFILE, as net/http.Server does
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if delay > time.Second {
+					delay = time.Second
+				}
+				logrus.Warnf("Tunnel %s: accept error: %s; retrying in %s.", t.id, err, delay)
+				time.Sleep(delay)
+				continue
+			}
+
+			logrus.Errorf("Tunnel %s: accept error: %s.", t.id, err)
+			r.deleteTunnel(t)
 			return
 		}
-		if n == 0 {
+		delay = 0
+		go r.serveConn(t, c)
+	}
+}
+
+// serveConn forwards tunnel's local connection via the owning agent's session.
+// If agent is disconnected, it waits for agent to reconnect up to queue timeout.
+func (r *Registry) serveConn(t *Tunnel, nc net.Conn) {
+	s := t.waitService(r.getQueueTimeout())
+	if s == nil {
+		nc.Close()
+		if !t.isClosed() {
+			err := &Error{
+				Code:    agent.ErrorCode_AGENT_UNAVAILABLE,
+				Message: fmt.Sprintf("agent %q is disconnected", t.agentUUID),
+			}
+			logrus.Warnf("Tunnel %s: refused connection from %s: %s.", t.id, nc.RemoteAddr(), err)
+			t.setError(err)
+		}
+		return
+	}
+	s.runTunnel(t, nc)
+}
+
+func (s *Service) runTunnel(t *Tunnel, nc net.Conn) {
+	c, err := s.openConn(context.Background(), t.dial, nc, t.weight)
+	if err != nil {
+		logrus.Errorf("Tunnel %s: %s (%s).", t.id, err, err.Code)
+		t.setError(err)
+		return
+	}
+	defer s.closeConn(c)
+
+	if !t.addConn(c) {
+		s.closeAgentTunnel(c.id)
+		return
+	}
+	defer t.removeConn(c.id)
+
+	s.forward(c)
+}
+
+// openConn asks agent to dial given address for local connection. On failure, local connection is closed.
+// If agent's connection breaks during the call, it is retried after session is resumed.
+// Waiting for agent's response or session resume stops when ctx is done.
+func (s *Service) openConn(ctx context.Context, dial string, nc net.Conn, weight int) (*localConn, *Error) {
+	for {
+		s.rw.RLock()
+		client, resumed := s.client, s.resumed
+		s.rw.RUnlock()
+
+		// register stream before agent may send anything
+		c := newLocalConn(atomic.AddUint64(&s.lastStreamID, 1), nc, weight, s.config.window())
+		s.rw.Lock()
+		s.streams[c.streamID] = c
+		s.rw.Unlock()
+
+		req := &agent.CreateTunnelRequest{
+			Dial: dial,
+		}
+		if !s.config.Legacy {
+			req.Window = uint32(c.window)
+			req.StreamId = c.streamID
+		}
+		rpcCtx, cancel := s.rpcContextWithParent(ctx, "CreateTunnel")
+		res, err := client.CreateTunnel(rpcCtx, req)
+		cancel()
+		if s.retryAfterResume(ctx, c, err, resumed) {
+			logrus.Debugf("Agent %q connection broke while dialing %s, retrying after session resume.", s.UUID(), dial)
 			continue
 		}
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		if err != nil || res.Error != "" {
+			s.closeConn(c)
+			return nil, callError(err, res.GetError(), res.GetErrorCode()).wrap("agent failed to dial %s", dial)
+		}
+		c.id = res.TunnelId
+		if s.config.Legacy {
+			s.registerConn(c)
+			return c, nil
+		}
+		if res.Window == 0 {
+			// agent would never get credit to send data to it
+			s.closeConn(c)
+			s.closeAgentTunnel(c.id)
+			return nil, &Error{
+				Code:    agent.ErrorCode_UNKNOWN,
+				Message: fmt.Sprintf("agent accepted connection to %s with zero window", dial),
+			}
+		}
+		credit := res.Window
+		if credit > uint32(c.window) {
+			credit = uint32(c.window)
+			c.sendCut = res.Window - credit
+		}
+		c.send.add(credit)
+		s.registerConn(c)
+		return c, nil
+	}
+}
 
-		res, err := s.client.WriteToTunnel(&agent.WriteToTunnelRequest{
-			TunnelId: tunnelID,
-			Data:     b[:n],
-		})
-		if err != nil {
+// registerConn registers local connection accepted by agent under agent's tunnel ID.
+func (s *Service) registerConn(c *localConn) {
+	s.rw.Lock()
+	s.conns[c.id] = c
+	close(s.connRegistered)
+	s.connRegistered = make(chan struct{})
+	s.rw.Unlock()
+}
+
+// closeConn closes local connection and unregisters it.
+func (s *Service) closeConn(c *localConn) {
+	c.Close()
+
+	s.rw.Lock()
+	delete(s.streams, c.streamID)
+	if c.id != "" {
+		delete(s.conns, c.id)
+	}
+	s.rw.Unlock()
+}
+
+// forward forwards data between local connection and agent until both directions are done,
+// or connection is aborted.
+func (s *Service) forward(c *localConn) {
+	if s.config.Legacy {
+		s.forwardLegacy(c)
+		return
+	}
+
+	go s.runWriter(c)
+
+	err := s.runReader(c)
+	switch {
+	case err == io.EOF:
+		// local client finished writing; wait for agent to finish too
+		if err = s.writeCloseWrite(c); err != nil {
 			logrus.Error(err)
 			return
 		}
-		if res.Error != "" {
-			logrus.Error(res.Error)
+		if !c.finishRead() {
+			<-c.done
+		}
+	case !c.isAborted():
+		logrus.Error(err)
+		s.closeAgentTunnel(c.id)
+	}
+}
+
+// runReader reads data from local connection and sends it to agent until error.
+// It returns io.EOF when local client finished writing.
+func (s *Service) runReader(c *localConn) error {
+	for {
+		// pause reading until agent has room for more data
+		size := c.send.wait(chunkSize)
+		if size == 0 {
+			return fmt.Errorf("tunnel %s is closed", c.id)
+		}
+
+		b, err := s.readChunk(c, size)
+		if len(b) != 0 {
+			if wErr := s.writeData(c, b); wErr != nil {
+				return wErr
+			}
+			s.stats.addToAgent(len(b))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// readChunk reads up to size bytes from local connection. If the first read returns less data,
+// it waits a bit for more to send it to agent in one chunk.
+func (s *Service) readChunk(c *localConn, size int) ([]byte, error) {
+	b := make([]byte, size)
+	n, err := c.Read(b)
+	if err != nil || n == size || s.config.CoalesceDelay == 0 {
+		return b[:n], err
+	}
+
+	c.SetReadDeadline(time.Now().Add(s.config.CoalesceDelay))
+	for n < size && err == nil {
+		var m int
+		m, err = c.Read(b[n:])
+		n += m
+	}
+	c.SetReadDeadline(time.Time{})
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		err = nil
+	}
+	return b[:n], err
+}
+
+// runWriter writes data received from agent to local connection, and replenishes agent's window.
+func (s *Service) runWriter(c *localConn) {
+	var consumed int
+	for {
+		b, closeWrite := c.queue.pop()
+		if b == nil {
+			if closeWrite {
+				if err := c.closeWrite(); err != nil {
+					logrus.Warnf("Tunnel %s: failed to close local connection for writing: %s.", c.id, err)
+				}
+			}
+			return
+		}
+
+		if _, err := c.Conn.Write(b); err != nil {
+			if !c.isAborted() {
+				logrus.Errorf("Tunnel %s: %s.", c.id, err)
+				s.closeAgentTunnel(c.id)
+				c.abort()
+			}
 			return
 		}
+
+		consumed += len(b)
+		if consumed >= windowUpdateThreshold(c.window) {
+			if err := s.writeWindowUpdate(c, consumed); err != nil {
+				logrus.Warnf("Tunnel %s: failed to update agent's window: %s.", c.id, err)
+			}
+			consumed = 0
+		}
+	}
+}
+
+// rpcContext returns context for agent's RPC method with configured timeout.
+// It is also canceled when session ends.
+func (s *Service) rpcContext(method string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(s.ctx, s.config.rpcTimeout(method))
+}
+
+// rpcContextWithParent is like rpcContext, but returned context is also canceled when parent is done.
+func (s *Service) rpcContextWithParent(parent context.Context, method string) (context.Context, context.CancelFunc) {
+	if parent.Done() == nil {
+		return s.rpcContext(method)
+	}
+
+	ctx, cancel := context.WithTimeout(parent, s.config.rpcTimeout(method))
+	go func() {
+		select {
+		case <-s.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// closeAgentTunnel tells agent to close its side of tunnel. Legacy agents can't be told.
+func (s *Service) closeAgentTunnel(tunnelID string) {
+	if s.config.Legacy {
+		return
+	}
+
+	ctx, cancel := s.rpcContext("CloseTunnel")
+	defer cancel()
+
+	res, err := s.getClient().CloseTunnel(ctx, &agent.CloseTunnelRequest{
+		TunnelId: tunnelID,
+	})
+	if err != nil || res.Error != "" {
+		tErr := callError(err, res.GetError(), res.GetErrorCode())
+		logrus.Warnf("Failed to close agent's tunnel %s: %s (%s).", tunnelID, tErr, tErr.Code)
 	}
 }
 
 func (s *Service) CreateTunnel(req *gateway.CreateTunnelRequest) (*gateway.CreateTunnelResponse, error) {
-	if req.AgentUuid != "" {
-		return nil, fmt.Errorf("req.AgentUuid (%q) is not handled yet", req.AgentUuid)
+	// agent may create tunnels only via itself
+	if req.AgentUuid != "" && req.AgentUuid != s.UUID() {
+		logrus.Warnf("Agent %q (authenticated by %s) tried to create tunnel via agent %q.", s.UUID(), s.identity.Method, req.AgentUuid)
+		return &gateway.CreateTunnelResponse{
+			Error:     fmt.Sprintf("agent %q may not create tunnels via agent %q", s.UUID(), req.AgentUuid),
+			ErrorCode: gateway.ErrorCode_POLICY_DENIED,
+		}, nil
 	}
 
-	l, err := net.Listen("tcp", "127.0.0.1:0")
+	t, err := s.OpenTunnel(req.Dial, TunnelOptions{})
 	if err != nil {
 		return &gateway.CreateTunnelResponse{
 			Error: err.Error(),
 		}, nil
 	}
-
-	go func() {
-		for {
-			c, err := l.Accept()
-			if err != nil {
-				logrus.Error(err)
-				continue
-			}
-			go s.runTunnel(c, req.Dial)
-		}
-	}()
-
 	return &gateway.CreateTunnelResponse{
-		Listen: l.Addr().String(),
+		Listen: t.Listen(),
 	}, nil
 }
 
-func (s *Service) WriteToTunnel(req *gateway.WriteToTunnelRequest) (*gateway.WriteToTunnelResponse, error) {
+func (s *Service) CloseTunnel(req *gateway.CloseTunnelRequest) (*gateway.CloseTunnelResponse, error) {
 	s.rw.RLock()
-	c := s.tunnels[req.TunnelId]
+	c := s.conns[req.TunnelId]
 	s.rw.RUnlock()
 	if c == nil {
-		return &gateway.WriteToTunnelResponse{Error: fmt.Sprintf("no such tunnel: %s", req.TunnelId)}, nil
+		return &gateway.CloseTunnelResponse{
+			Error:     fmt.Sprintf("no such tunnel: %s", req.TunnelId),
+			ErrorCode: gateway.ErrorCode_UNKNOWN_TUNNEL,
+		}, nil
 	}
 
-	if _, err := c.Write(req.Data); err != nil {
-		return &gateway.WriteToTunnelResponse{
+	if err := c.abort(); err != nil {
+		return &gateway.CloseTunnelResponse{
 			Error: err.Error(),
 		}, nil
 	}
-	return &gateway.WriteToTunnelResponse{}, nil
+	return &gateway.CloseTunnelResponse{}, nil
+}
+
+// handleFrame handles data stream frame from agent. It is called from connection's reading goroutine.
+func (s *Service) handleFrame(f *wsrpc.Frame) {
+	s.rw.RLock()
+	c := s.streams[f.StreamID]
+	s.rw.RUnlock()
+	if c == nil {
+		// acks may arrive after stream is closed
+		if f.Type != wsrpc.FrameAck {
+			logrus.Warnf("Unexpected %s frame for unknown stream %d.", f.Type, f.StreamID)
+		}
+		return
+	}
+
+	switch f.Type {
+	case wsrpc.FrameData:
+		s.stats.addFromAgent(len(f.Data))
+		if err := c.queue.push(f.Data); err != nil {
+			logrus.Errorf("Stream %d: %s.", f.StreamID, err)
+			go func() {
+				s.closeAgentTunnel(c.id)
+				c.abort()
+			}()
+			return
+		}
+		s.onReceived(c, uint64(len(f.Data)), false)
+	case wsrpc.FrameWindowUpdate:
+		c.send.add(f.Increment)
+	case wsrpc.FrameCloseWrite:
+		// write side is closed after all queued data is written
+		c.queue.pushCloseWrite()
+		s.onReceived(c, 1, true)
+	case wsrpc.FrameAck:
+		c.replayM.Lock()
+		c.ack(f.Ack)
+		c.replayM.Unlock()
+	}
 }
 
 // check interfaces
@@ -0,0 +1,266 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tunnel
+
+import (
+	"context"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Percona-Lab/wsrpc"
+
+	"github.com/Percona-Lab/pmm-gateway/auth"
+	"github.com/Percona-Lab/pmm-gateway/ports"
+)
+
+// dialPair returns connected gateway's service, agent's connection, and a function closing them.
+func dialPair(t *testing.T, registry *Registry, config Config) (*Service, *wsrpc.Conn, func()) {
+	t.Helper()
+
+	gwConns := make(chan *wsrpc.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		conn, err := wsrpc.Upgrade(rw, req, nil)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		gwConns <- conn
+	}))
+
+	agentConn, _, err := wsrpc.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+
+	gwConn := <-gwConns
+	closeFunc := func() {
+		agentConn.Close()
+		gwConn.Close()
+		server.Close()
+	}
+	return NewService(&auth.Identity{AgentUUID: "agent1"}, "test", gwConn, registry, config), agentConn, closeFunc
+}
+
+// waitFor waits until f returns true.
+func waitFor(t *testing.T, what string, f func() bool) {
+	t.Helper()
+
+	for start := time.Now(); !f(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+// zeroConn is a local connection which reads given number of zero bytes without waiting.
+type zeroConn struct {
+	net.Conn
+	n int64 // atomic
+}
+
+func (c *zeroConn) Read(b []byte) (int, error) {
+	n := atomic.LoadInt64(&c.n)
+	if n == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > n {
+		b = b[:n]
+	}
+	atomic.AddInt64(&c.n, -int64(len(b)))
+	return len(b), nil
+}
+
+func (c *zeroConn) Close() error {
+	return nil
+}
+
+func TestWeights(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		weights  [2]int
+		expected []uint64 // streams of data frames received by agent
+	}{
+		{"Equal", [2]int{1, 1}, []uint64{1, 2, 1, 2}},
+		{"1:3", [2]int{1, 3}, []uint64{1, 2, 2, 2, 1, 2, 2, 2}},
+		{"4:1", [2]int{4, 1}, []uint64{1, 1, 1, 1, 2, 1, 1, 1, 1, 2}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc, agentConn, closeFunc := dialPair(t, nil, Config{})
+			defer closeFunc()
+
+			var actual []uint64
+			received := make(map[uint64]int)
+			release := make(chan struct{})
+			done := make(chan struct{})
+			agentConn.SetFrameHandler(func(f *wsrpc.Frame) {
+				<-release
+				if f.StreamID == 3 {
+					return
+				}
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				actual = append(actual, f.StreamID)
+				received[f.StreamID] += len(f.Data)
+				if received[1] == 2*tc.weights[0]*chunkSize && received[2] == 2*tc.weights[1]*chunkSize {
+					close(done)
+				}
+			})
+
+			// stream 3 fills connection buffers while agent is not reading, so that gateway stops writing
+			filler := &zeroConn{n: math.MaxInt64}
+			c := newLocalConn(3, filler, 1, DefaultWindow)
+			c.send.add(math.MaxUint32)
+			defer c.Close()
+			go svc.runReader(c)
+			waitFor(t, "full buffers", func() bool {
+				n := atomic.LoadInt64(&filler.n)
+				time.Sleep(200 * time.Millisecond)
+				return atomic.LoadInt64(&filler.n) == n
+			})
+
+			// then each stream queues data for two scheduling rounds
+			for i, w := range tc.weights {
+				local := &zeroConn{n: int64(2 * w * chunkSize)}
+				c := newLocalConn(uint64(i+1), local, w, DefaultWindow)
+				c.send.add(math.MaxUint32)
+				defer c.Close()
+				go svc.runReader(c)
+				waitFor(t, "queued data", func() bool { return atomic.LoadInt64(&local.n) == 0 })
+			}
+
+			close(release)
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("timeout, received %v", actual)
+			}
+			if !reflect.DeepEqual(tc.expected, actual) {
+				t.Errorf("expected %v, got %v", tc.expected, actual)
+			}
+		})
+	}
+}
+
+func TestOpenTunnelDuplicate(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	min := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	allocator, err := ports.New(min, min+9, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		ports *ports.Allocator
+	}{
+		{"RandomPorts", nil},
+		{"Allocator", allocator},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc, _, closeFunc := dialPair(t, NewRegistry(), Config{Ports: tc.ports})
+			defer closeFunc()
+			defer svc.Close()
+
+			t1, err := svc.OpenTunnel("127.0.0.1:9100", TunnelOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = svc.OpenTunnel("127.0.0.1:9100", TunnelOptions{ServiceType: "node_exporter"})
+			expected := `tunnel to 127.0.0.1:9100 via agent "agent1" already exists on ` + t1.Listen()
+			if err == nil || err.Error() != expected {
+				t.Errorf("expected error %q, got %v", expected, err)
+			}
+			if _, err = svc.OpenTunnel("127.0.0.1:9101", TunnelOptions{}); err != nil {
+				t.Error(err)
+			}
+
+			// the same dial address can be used again after tunnel is deleted
+			if err = svc.DeleteTunnel(t1.ID()); err != nil {
+				t.Fatal(err)
+			}
+			t2, err := svc.OpenTunnel("127.0.0.1:9100", TunnelOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.ports != nil && t2.Listen() != t1.Listen() {
+				t.Errorf("expected the same port %s, got %s", t1.Listen(), t2.Listen())
+			}
+		})
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		dial func(ctx context.Context, svc *Service) error
+	}{
+		{"Dial", func(ctx context.Context, svc *Service) error {
+			c, err := svc.DialContext(ctx, "127.0.0.1:9100")
+			if err == nil {
+				c.Close()
+			}
+			return err
+		}},
+		{"Transport", func(ctx context.Context, svc *Service) error {
+			req, err := http.NewRequest("GET", "http://127.0.0.1:9100/metrics", nil)
+			if err != nil {
+				return err
+			}
+			res, err := svc.Transport().RoundTrip(req.WithContext(ctx))
+			if err == nil {
+				res.Body.Close()
+			}
+			return err
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// agent never responds to CreateTunnel
+			svc, agentConn, closeFunc := dialPair(t, NewRegistry(), Config{})
+			defer closeFunc()
+			defer svc.Close()
+			agentConn.SetFrameHandler(func(*wsrpc.Frame) {})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			start := time.Now()
+			err := tc.dial(ctx, svc)
+			if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+				t.Errorf("unexpected error %v", err)
+			}
+			if d := time.Since(start); d > DefaultRPCTimeout/2 {
+				t.Errorf("context is not honoured, dial took %s", d)
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tunnel
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Flow control is credit-based and works per tunnel in each direction independently.
+// Receiver advertises initial window when tunnel is created, and sender may have at most
+// that many bytes not yet consumed by receiver. Receiver replenishes sender's credit
+// with window update frames as it writes data to its side of the tunnel.
+// That way a slow consumer pauses only its own tunnel, not the whole agent session.
+// Gateway also limits its own credit to configured window, even if agent advertised a larger one.
+
+// DefaultWindow is the default value of Config.Window.
+const DefaultWindow = 256 * 1024
+
+// windowUpdateThreshold returns the number of consumed bytes after which window update is sent.
+func windowUpdateThreshold(window int) int {
+	return window / 4
+}
+
+// sendWindow tracks the number of bytes gateway may send to agent.
+type sendWindow struct {
+	m      sync.Mutex
+	c      *sync.Cond
+	credit int64
+	closed bool
+}
+
+// newSendWindow creates a new send window without credit.
+func newSendWindow() *sendWindow {
+	w := new(sendWindow)
+	w.c = sync.NewCond(&w.m)
+	return w
+}
+
+// wait blocks until there is some credit, and returns it limited by max.
+// It returns 0 if window is closed.
+func (w *sendWindow) wait(max int) int {
+	w.m.Lock()
+	defer w.m.Unlock()
+
+	for w.credit <= 0 && !w.closed {
+		w.c.Wait()
+	}
+	if w.closed {
+		return 0
+	}
+	if w.credit < int64(max) {
+		return int(w.credit)
+	}
+	return max
+}
+
+// consume decreases credit by n sent bytes.
+func (w *sendWindow) consume(n int) {
+	w.m.Lock()
+	w.credit -= int64(n)
+	w.m.Unlock()
+}
+
+// add increases credit by agent's initial window or window update.
+func (w *sendWindow) add(n uint32) {
+	w.m.Lock()
+	w.credit += int64(n)
+	w.m.Unlock()
+	w.c.Broadcast()
+}
+
+// reset sets credit computed from agent's stream state on session resume.
+func (w *sendWindow) reset(credit int64) {
+	w.m.Lock()
+	w.credit = credit
+	w.m.Unlock()
+	w.c.Broadcast()
+}
+
+// close wakes up and fails all waiters.
+func (w *sendWindow) close() {
+	w.m.Lock()
+	w.closed = true
+	w.m.Unlock()
+	w.c.Broadcast()
+}
+
+// writeQueue buffers data received from agent until it is written to local connection.
+type writeQueue struct {
+	m          sync.Mutex
+	c          *sync.Cond
+	bufs       [][]byte
+	size       int
+	limit      int
+	closeWrite bool // agent finished writing; set after all data
+	closed     bool
+}
+
+// newWriteQueue creates a new queue holding at most limit bytes.
+func newWriteQueue(limit int) *writeQueue {
+	q := &writeQueue{
+		limit: limit,
+	}
+	q.c = sync.NewCond(&q.m)
+	return q
+}
+
+// push adds data to the queue. It returns error if agent exceeded its window.
+func (q *writeQueue) push(b []byte) error {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	switch {
+	case q.closed:
+		return fmt.Errorf("tunnel is closed")
+	case q.closeWrite:
+		return fmt.Errorf("tunnel is closed for writing")
+	case q.size+len(b) > q.limit:
+		return fmt.Errorf("flow control window exceeded: %d bytes queued, %d received, window is %d", q.size, len(b), q.limit)
+	}
+	q.bufs = append(q.bufs, b)
+	q.size += len(b)
+	q.c.Signal()
+	return nil
+}
+
+// pushCloseWrite marks the end of data.
+func (q *writeQueue) pushCloseWrite() {
+	q.m.Lock()
+	q.closeWrite = true
+	q.m.Unlock()
+	q.c.Signal()
+}
+
+// pop blocks until data is available and returns it. It returns nil data and closeWrite = true
+// after all data was returned and agent finished writing, and nil data and false if queue is closed.
+func (q *writeQueue) pop() (b []byte, closeWrite bool) {
+	q.m.Lock()
+	defer q.m.Unlock()
+
+	for len(q.bufs) == 0 && !q.closeWrite && !q.closed {
+		q.c.Wait()
+	}
+	if q.closed {
+		return nil, false
+	}
+	if len(q.bufs) == 0 {
+		return nil, true
+	}
+	b = q.bufs[0]
+	q.bufs[0] = nil
+	q.bufs = q.bufs[1:]
+	q.size -= len(b)
+	return b, false
+}
+
+// close drops all queued data and wakes up the reader.
+func (q *writeQueue) close() {
+	q.m.Lock()
+	q.closed = true
+	q.bufs = nil
+	q.size = 0
+	q.m.Unlock()
+	q.c.Signal()
+}
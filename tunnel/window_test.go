@@ -0,0 +1,265 @@
+// pmm-gateway
+// Copyright (C) 2018 Percona LLC
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published
+// by the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program. If not, see <http://www.gnu.org/licenses/>.
+
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Percona-Lab/pmm-api/agent"
+	"github.com/Percona-Lab/wsrpc"
+)
+
+func TestSendWindow(t *testing.T) {
+	w := newSendWindow()
+	for i, step := range []struct {
+		add      uint32
+		reset    int64
+		consume  int
+		expected int // wait(64) result
+	}{
+		{add: 100, expected: 64},
+		{consume: 64, expected: 36},
+		{add: 10, expected: 46},
+		{consume: 46, add: 1000, expected: 64},
+		{reset: -10, add: 15, expected: 5}, // data sent before resume was not acknowledged
+	} {
+		if step.reset != 0 {
+			w.reset(step.reset)
+		}
+		w.consume(step.consume)
+		w.add(step.add)
+		if actual := w.wait(64); actual != step.expected {
+			t.Errorf("step %d: expected %d, got %d", i, step.expected, actual)
+		}
+	}
+}
+
+func TestSendWindowWait(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		wake     func(w *sendWindow)
+		expected int
+	}{
+		{"Add", func(w *sendWindow) { w.add(10) }, 10},
+		{"Reset", func(w *sendWindow) { w.reset(20) }, 20},
+		{"Close", func(w *sendWindow) { w.close() }, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := newSendWindow()
+			res := make(chan int)
+			go func() { res <- w.wait(64) }()
+
+			select {
+			case n := <-res:
+				t.Fatalf("wait returned %d without credit", n)
+			case <-time.After(50 * time.Millisecond):
+			}
+			tc.wake(w)
+			select {
+			case n := <-res:
+				if n != tc.expected {
+					t.Errorf("expected %d, got %d", tc.expected, n)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("wait is not woken up")
+			}
+		})
+	}
+}
+
+func TestWriteQueue(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		push     []string
+		close    bool   // close queue after push
+		errors   []bool // expected push errors
+		expected []string
+		final    bool // expected closeWrite value of the final pop
+	}{
+		{"Data", []string{"ab", "cd"}, false, []bool{false, false}, []string{"ab", "cd"}, true},
+		{"WindowExceeded", []string{"abc", "de", "f"}, false, []bool{false, true, false}, []string{"abc", "f"}, true},
+		{"Closed", []string{"ab"}, true, []bool{false}, nil, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := newWriteQueue(4)
+			for i, s := range tc.push {
+				if err := q.push([]byte(s)); (err != nil) != tc.errors[i] {
+					t.Errorf("push %q: unexpected error %v", s, err)
+				}
+			}
+			if tc.close {
+				q.close()
+			} else {
+				q.pushCloseWrite()
+				if err := q.push([]byte("g")); err == nil || err.Error() != "tunnel is closed for writing" {
+					t.Errorf("unexpected error after close write %v", err)
+				}
+			}
+
+			var actual []string
+			for _, s := range tc.expected {
+				b, closeWrite := q.pop()
+				if closeWrite {
+					t.Fatalf("unexpected close write, expected %q", s)
+				}
+				actual = append(actual, string(b))
+			}
+			if !reflect.DeepEqual(tc.expected, actual) {
+				t.Errorf("expected %q, got %q", tc.expected, actual)
+			}
+			if b, closeWrite := q.pop(); b != nil || closeWrite != tc.final {
+				t.Errorf("expected final pop nil and %v, got %q and %v", tc.final, b, closeWrite)
+			}
+		})
+	}
+}
+
+// windowAgent accepts streams with given window.
+type windowAgent struct {
+	window uint32
+	reqs   chan *agent.CreateTunnelRequest
+}
+
+func (a *windowAgent) CreateTunnel(req *agent.CreateTunnelRequest) (*agent.CreateTunnelResponse, error) {
+	a.reqs <- req
+	return &agent.CreateTunnelResponse{TunnelId: "tunnel1", Window: a.window}, nil
+}
+
+func (a *windowAgent) WriteToTunnel(req *agent.WriteToTunnelRequest) (*agent.WriteToTunnelResponse, error) {
+	return nil, fmt.Errorf("not implemented")
+}
+
+func (a *windowAgent) CloseTunnel(req *agent.CloseTunnelRequest) (*agent.CloseTunnelResponse, error) {
+	return &agent.CloseTunnelResponse{}, nil
+}
+
+func TestCredit(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		window      int    // gateway's window
+		agentWindow uint32 // agent's initial window
+		credit      int    // expected gateway's send credit
+		sendCut     uint32
+	}{
+		{"Default", 0, DefaultWindow, DefaultWindow, 0},
+		{"SmallerAgentWindow", 4096, 1024, 1024, 0},
+		{"LargerAgentWindow", 4096, 10000, 4096, 10000 - 4096},
+		{"ZeroAgentWindow", 4096, 0, 0, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			svc, agentConn, closeFunc := dialPair(t, NewRegistry(), Config{Window: tc.window})
+			defer closeFunc()
+			defer svc.Close()
+			a := &windowAgent{
+				window: tc.agentWindow,
+				reqs:   make(chan *agent.CreateTunnelRequest, 1),
+			}
+			agentConn.SetFrameHandler(func(*wsrpc.Frame) {})
+			go agent.NewServiceDispatcher(agentConn, a).Run()
+
+			local, remote := net.Pipe()
+			defer local.Close()
+			c, err := svc.openConn(context.Background(), "127.0.0.1:9100", remote, 1)
+			if req := <-a.reqs; req.Window != uint32(svc.config.window()) {
+				t.Errorf("expected advertised window %d, got %d", svc.config.window(), req.Window)
+			}
+			if tc.agentWindow == 0 {
+				if err == nil || err.Message != "agent accepted connection to 127.0.0.1:9100 with zero window" {
+					t.Errorf("unexpected error %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer svc.closeConn(c)
+
+			if credit := c.send.wait(math.MaxInt32); credit != tc.credit || c.sendCut != tc.sendCut {
+				t.Errorf("expected credit %d and cut %d, got %d and %d", tc.credit, tc.sendCut, credit, c.sendCut)
+			}
+		})
+	}
+}
+
+func TestWindowUpdates(t *testing.T) {
+	const window = 4096
+	svc, agentConn, closeFunc := dialPair(t, NewRegistry(), Config{Window: window})
+	defer closeFunc()
+	defer svc.Close()
+	a := &windowAgent{
+		window: window,
+		reqs:   make(chan *agent.CreateTunnelRequest, 1),
+	}
+	updates := make(chan uint32, 10)
+	agentConn.SetFrameHandler(func(f *wsrpc.Frame) {
+		if f.Type == wsrpc.FrameWindowUpdate {
+			updates <- f.Increment
+		}
+	})
+	go agent.NewServiceDispatcher(agentConn, a).Run()
+
+	local, err := svc.Dial("127.0.0.1:9100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	streamID := (<-a.reqs).StreamId
+
+	// agent uses the whole window, and gets it back in parts as data is written to local connection
+	data := bytes.Repeat([]byte{42}, window)
+	threshold := windowUpdateThreshold(window)
+	for i := 0; i < len(data); i += threshold / 2 {
+		err = agentConn.WriteFrame(&wsrpc.Frame{
+			StreamID: streamID,
+			Type:     wsrpc.FrameData,
+			Data:     data[i : i+threshold/2],
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	local.SetDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, len(data))
+	if _, err = io.ReadFull(local, b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, b) {
+		t.Error("unexpected data")
+	}
+
+	var actual []uint32
+	for len(actual) < window/threshold {
+		select {
+		case inc := <-updates:
+			actual = append(actual, inc)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timeout, received updates %v", actual)
+		}
+	}
+	expected := []uint32{uint32(threshold), uint32(threshold), uint32(threshold), uint32(threshold)}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected updates %v, got %v", expected, actual)
+	}
+}